@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bitly/statsdaemon/statsd"
+)
+
+// bench runs "statsdaemon bench [flags]": it sends synthetic traffic to a
+// daemon, in this process unless -target is given, and checks what the
+// daemon flushes to a fake graphite against what was sent.
+func bench(args []string) {
+	target := flag.String("target", "", "address (or unix socket path) of the daemon to benchmark; if empty one is started in process with the usual flags")
+	protocol := flag.String("protocol", "udp", "how to send: udp, tcp or unix")
+	fakeGraphite := flag.String("fake-graphite", "127.0.0.1:2103", "address to accept graphite connections on; point the -target daemon's -graphite here")
+	duration := flag.Duration("duration", 10*time.Second, "how long to send for")
+	rate := flag.Int("rate", 0, "lines per second to send across all senders (0 for as fast as possible)")
+	senders := flag.Int("senders", 4, "number of concurrent connections to send from")
+	mixFlag := flag.String("mix", "c=50,g=20,ms=20,s=10", "relative share of counter, gauge, timer and set lines")
+	buckets := flag.Int("buckets", 1000, "number of distinct buckets per metric type")
+	sampleRate := flag.Float64("sample-rate", 1, "sample rate sent with counters and timers")
+	batch := flag.Int("batch", 10, "lines per packet (packets are kept under -max-udp-packet-size)")
+	settle := flag.Duration("settle", 0, "how long to wait after sending for a -target daemon to flush everything (default two -flush-interval)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s bench [flags]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.CommandLine.Parse(args)
+
+	mix, err := parseMix(*mixFlag)
+	if err != nil {
+		log.Fatalf("ERROR: -mix - %s", err)
+	}
+	if *senders < 1 || *buckets < *senders || *batch < 1 || *sampleRate <= 0 || *sampleRate > 1 {
+		log.Fatalf("ERROR: need -senders >= 1, -buckets >= -senders, -batch >= 1 and 0 < -sample-rate <= 1")
+	}
+
+	graphite, err := newFakeGraphite(*fakeGraphite)
+	if err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+
+	var server *statsd.Server
+	address := *target
+	if address == "" {
+		server, address = startBenchServer(*protocol, graphite.Addr())
+	}
+
+	network := *protocol
+	if network == "unix" {
+		network = "unixgram"
+	}
+	results := make([]*benchSender, *senders)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := range results {
+		conn, err := net.Dial(network, address)
+		if err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+		results[i] = &benchSender{
+			id:         i,
+			senders:    *senders,
+			buckets:    *buckets,
+			mix:        mix,
+			sampleRate: *sampleRate,
+			batch:      *batch,
+			maxPacket:  opts.MaxUdpPacketSize,
+			lastGauges: make(map[string]float64),
+			rng:        rand.New(rand.NewSource(int64(i))),
+		}
+		wg.Add(1)
+		go func(s *benchSender) {
+			defer wg.Done()
+			defer conn.Close()
+			s.send(conn, start.Add(*duration), float64(*rate)/float64(*senders))
+		}(results[i])
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	if server != nil {
+		if err := server.Stop(); err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+	} else {
+		wait := *settle
+		if wait == 0 {
+			wait = 2 * time.Duration(opts.FlushInterval) * time.Second
+		}
+		log.Printf("waiting %s for the daemon to flush", wait)
+		time.Sleep(wait)
+	}
+	graphite.Close()
+
+	report(os.Stdout, results, elapsed, *protocol, graphite)
+}
+
+// startBenchServer starts a daemon configured by the command line flags,
+// listening on a local address for protocol and flushing to graphite.
+func startBenchServer(protocol string, graphite string) (*statsd.Server, string) {
+	opts.Backend = statsd.NewGraphiteBackend(graphite)
+	if opts.ReceiveCounter == "" {
+		opts.ReceiveCounter = "statsdaemon.received"
+	}
+	var address string
+	switch protocol {
+	case "udp":
+		address = "127.0.0.1:18125"
+		opts.Listeners = []statsd.Listener{&statsd.UDPListener{Address: address}}
+	case "tcp":
+		address = "127.0.0.1:18125"
+		opts.Listeners = []statsd.Listener{&statsd.TCPListener{Address: address}}
+	case "unix":
+		address = filepath.Join(os.TempDir(), fmt.Sprintf("statsdaemon-bench-%d.sock", os.Getpid()))
+		opts.Listeners = []statsd.Listener{&statsd.UnixListener{Path: address}}
+	default:
+		log.Fatalf("ERROR: -protocol must be udp, tcp or unix")
+	}
+	server, err := statsd.NewServer(opts)
+	if err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+	if err := server.Start(); err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+	return server, address
+}
+
+var benchTypes = []string{"c", "g", "ms", "s"}
+
+// parseMix parses "c=50,g=20,ms=20,s=10" into cumulative weights in the
+// order of benchTypes.
+func parseMix(s string) ([]int, error) {
+	weights := make(map[string]int)
+	for _, part := range strings.Split(s, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid share %q (want TYPE=WEIGHT)", part)
+		}
+		w, err := strconv.Atoi(kv[1])
+		if err != nil || w < 0 {
+			return nil, fmt.Errorf("invalid weight %q", kv[1])
+		}
+		switch kv[0] {
+		case "c", "g", "ms", "s":
+			weights[kv[0]] = w
+		default:
+			return nil, fmt.Errorf("invalid type %q", kv[0])
+		}
+	}
+	cumulative := make([]int, len(benchTypes))
+	total := 0
+	for i, t := range benchTypes {
+		total += weights[t]
+		cumulative[i] = total
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("no weights")
+	}
+	return cumulative, nil
+}
+
+// benchSender sends lines for its own share of the buckets, so that the
+// last gauge value of every bucket is known, and counts what it sent.
+type benchSender struct {
+	id, senders, buckets int
+	mix                  []int
+	sampleRate           float64
+	batch, maxPacket     int
+	rng                  *rand.Rand
+
+	lines, packets, errors int64
+	counterTotal           float64
+	timerCount             int64
+	lastGauges             map[string]float64
+	byType                 map[string]int64
+}
+
+func (b *benchSender) send(conn net.Conn, end time.Time, rate float64) {
+	b.byType = make(map[string]int64)
+	stream := conn.RemoteAddr() != nil && conn.RemoteAddr().Network() == "tcp"
+	start := time.Now()
+	var packet []byte
+	line := b.line()
+	for time.Now().Before(end) {
+		packet = packet[:0]
+		for i := 0; i < b.batch; i, line = i+1, b.line() {
+			if len(packet) > 0 && len(packet)+1+len(line) > b.maxPacket {
+				break
+			}
+			if len(packet) > 0 {
+				packet = append(packet, '\n')
+			}
+			packet = append(packet, line...)
+			b.count(line)
+		}
+		if stream {
+			packet = append(packet, '\n')
+		}
+		if _, err := conn.Write(packet); err != nil {
+			b.errors++
+		}
+		b.packets++
+
+		if rate > 0 {
+			due := start.Add(time.Duration(float64(b.lines) / rate * float64(time.Second)))
+			time.Sleep(time.Until(due))
+		}
+	}
+}
+
+// line returns a random line for one of b's buckets.
+func (b *benchSender) line() string {
+	n := b.rng.Intn(b.mix[len(b.mix)-1])
+	t := 0
+	for n >= b.mix[t] {
+		t++
+	}
+	kind := benchTypes[t]
+	bucket := b.id + b.rng.Intn(b.buckets/b.senders)*b.senders
+	name := "bench." + kind + "." + strconv.Itoa(bucket)
+
+	rate := ""
+	if b.sampleRate < 1 {
+		rate = "|@" + strconv.FormatFloat(b.sampleRate, 'g', -1, 64)
+	}
+	switch kind {
+	case "c":
+		return name + ":1|c" + rate
+	case "g":
+		return name + ":" + strconv.Itoa(b.rng.Intn(1000)) + "|g"
+	case "ms":
+		return name + ":" + strconv.Itoa(b.rng.Intn(1000)) + "|ms" + rate
+	default:
+		return name + ":" + strconv.Itoa(b.rng.Intn(100)) + "|s"
+	}
+}
+
+func (b *benchSender) count(line string) {
+	b.lines++
+	colon := strings.IndexByte(line, ':')
+	kind := line[strings.IndexByte(line, '|')+1:]
+	if i := strings.IndexByte(kind, '|'); i >= 0 {
+		kind = kind[:i]
+	}
+	b.byType[kind]++
+	switch kind {
+	case "c":
+		b.counterTotal += 1 / b.sampleRate
+	case "ms":
+		b.timerCount++
+	case "g":
+		v, _ := strconv.ParseFloat(line[colon+1:strings.IndexByte(line, '|')], 64)
+		b.lastGauges[line[:colon]] = v
+	}
+}
+
+// fakeGraphite accepts graphite plaintext connections and keeps every line.
+type fakeGraphite struct {
+	listener net.Listener
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	lines    []string
+}
+
+func newFakeGraphite(address string) (*fakeGraphite, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("fake graphite - %s", err)
+	}
+	g := &fakeGraphite{listener: listener}
+	go g.accept()
+	return g, nil
+}
+
+func (g *fakeGraphite) Addr() string {
+	return g.listener.Addr().String()
+}
+
+func (g *fakeGraphite) accept() {
+	for {
+		conn, err := g.listener.Accept()
+		if err != nil {
+			return
+		}
+		g.wg.Add(1)
+		go func() {
+			defer g.wg.Done()
+			defer conn.Close()
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				g.mu.Lock()
+				g.lines = append(g.lines, scanner.Text())
+				g.mu.Unlock()
+			}
+		}()
+	}
+}
+
+// Close stops accepting and waits for the open connections to finish.
+func (g *fakeGraphite) Close() {
+	g.listener.Close()
+	g.wg.Wait()
+}
+
+// report compares what was sent with what reached graphite.
+func report(out io.Writer, senders []*benchSender, elapsed time.Duration, protocol string, g *fakeGraphite) {
+	var lines, packets, errors, timerCount int64
+	var counterTotal float64
+	byType := make(map[string]int64)
+	lastGauges := make(map[string]float64)
+	for _, s := range senders {
+		lines += s.lines
+		packets += s.packets
+		errors += s.errors
+		counterTotal += s.counterTotal
+		timerCount += s.timerCount
+		for t, n := range s.byType {
+			byType[t] += n
+		}
+		for bucket, v := range s.lastGauges {
+			lastGauges[bucket] = v
+		}
+	}
+
+	var gotCounters, gotTimers float64
+	gotGauges := make(map[string]float64)
+	gaugeTimes := make(map[string]int64)
+	self := make(map[string]float64)
+	for _, line := range g.lines {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		name := fields[0]
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			continue
+		}
+		ts, _ := strconv.ParseInt(fields[2], 10, 64)
+		unfixed := strings.TrimSuffix(name, opts.Postfix)
+		for _, counter := range []string{opts.ReceiveCounter, opts.RateLimitCounter, opts.FilterCounter, opts.CardinalityCounter} {
+			if counter != "" && strings.Contains(name, counter) && !strings.HasSuffix(unfixed, opts.RateSuffix) && !strings.HasSuffix(unfixed, ".rate") {
+				self[name] += value
+			}
+		}
+
+		i := strings.Index(name, "bench.")
+		if i < 0 {
+			continue
+		}
+		parts := strings.Split(strings.TrimSuffix(name[i:], opts.Postfix), ".")
+		if len(parts) < 3 {
+			continue
+		}
+		if _, err := strconv.Atoi(parts[2]); err != nil {
+			continue // rates
+		}
+		stat := strings.Join(parts[3:], ".")
+		bucket := strings.Join(parts[:3], ".")
+		switch {
+		case parts[1] == "c" && (stat == "" || stat == "count"):
+			gotCounters += value
+		case parts[1] == "ms" && stat == "count":
+			gotTimers += value
+		case parts[1] == "g" && stat == "" && ts >= gaugeTimes[bucket]:
+			gotGauges[bucket] = value
+			gaugeTimes[bucket] = ts
+		}
+	}
+
+	fmt.Fprintf(out, "sent %d lines in %d packets over %s in %s: %.0f lines/s, %.0f packets/s",
+		lines, packets, protocol, elapsed.Round(time.Millisecond),
+		float64(lines)/elapsed.Seconds(), float64(packets)/elapsed.Seconds())
+	if errors > 0 {
+		fmt.Fprintf(out, ", %d send errors", errors)
+	}
+	fmt.Fprintln(out)
+	fmt.Fprintf(out, "  counters %d, gauges %d, timers %d, sets %d\n", byType["c"], byType["g"], byType["ms"], byType["s"])
+
+	var names []string
+	for name := range self {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "daemon %s: %.0f\n", name, self[name])
+	}
+
+	fmt.Fprintf(out, "graphite received %d lines\n", len(g.lines))
+	fmt.Fprintf(out, "  counters: %s\n", compare(counterTotal, gotCounters))
+	fmt.Fprintf(out, "  timer counts: %s\n", compare(float64(timerCount), gotTimers))
+	matched := 0
+	for bucket, v := range lastGauges {
+		if got, ok := gotGauges[bucket]; ok && got == v {
+			matched++
+		}
+	}
+	fmt.Fprintf(out, "  gauges: %d of %d buckets have the last value sent\n", matched, len(lastGauges))
+}
+
+func compare(sent, got float64) string {
+	if sent == 0 {
+		return fmt.Sprintf("sent 0, got %g", got)
+	}
+	missing := (sent - got) / sent * 100
+	if math.Abs(missing) < 1e-6 {
+		return fmt.Sprintf("sent %g, got all of them", sent)
+	}
+	return fmt.Sprintf("sent %g, got %g (%.2f%% missing)", sent, got, missing)
+}
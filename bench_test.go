@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMix(t *testing.T) {
+	mix, err := parseMix("c=50,g=20,ms=20,s=10")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []int{50, 70, 90, 100}, mix)
+
+	// in benchTypes order whatever the order given, missing types get nothing
+	mix, err = parseMix("ms=1,c=3")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []int{3, 3, 4, 4}, mix)
+
+	for _, s := range []string{"", "c", "c=x", "c=-1", "h=1", "c=0,g=0"} {
+		_, err = parseMix(s)
+		assert.NotEqual(t, nil, err, s)
+	}
+}
+
+func newTestSender(sampleRate float64) *benchSender {
+	mix, _ := parseMix("c=1,g=1,ms=1,s=1")
+	return &benchSender{
+		id:         1,
+		senders:    2,
+		buckets:    10,
+		mix:        mix,
+		sampleRate: sampleRate,
+		rng:        rand.New(rand.NewSource(1)),
+		lastGauges: make(map[string]float64),
+		byType:     make(map[string]int64),
+	}
+}
+
+func TestBenchSenderCount(t *testing.T) {
+	b := newTestSender(0.5)
+	for _, line := range []string{
+		"bench.c.1:1|c|@0.5",
+		"bench.c.3:1|c|@0.5",
+		"bench.ms.1:12|ms|@0.5",
+		"bench.g.1:5|g",
+		"bench.g.1:7|g",
+		"bench.s.3:42|s",
+	} {
+		b.count(line)
+	}
+	assert.Equal(t, int64(6), b.lines)
+	assert.Equal(t, float64(4), b.counterTotal)
+	assert.Equal(t, int64(1), b.timerCount)
+	assert.Equal(t, map[string]float64{"bench.g.1": 7}, b.lastGauges)
+	assert.Equal(t, map[string]int64{"c": 2, "ms": 1, "g": 2, "s": 1}, b.byType)
+}
+
+func TestBenchSenderLine(t *testing.T) {
+	b := newTestSender(0.5)
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		line := b.line()
+		b.count(line)
+		p := parseBenchName(t, line)
+		seen[p.kind] = true
+		// only this sender's share of the buckets
+		assert.Equal(t, 1, p.bucket%2, line)
+		assert.True(t, p.bucket < 10, line)
+		if p.kind == "c" || p.kind == "ms" {
+			assert.Contains(t, line, "|@0.5")
+		} else {
+			assert.NotContains(t, line, "|@")
+		}
+	}
+	assert.Equal(t, map[string]bool{"c": true, "g": true, "ms": true, "s": true}, seen)
+	assert.Equal(t, int64(1000), b.lines)
+
+	// weights of zero are never picked
+	b.mix, _ = parseMix("g=1")
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, "g", parseBenchName(t, b.line()).kind)
+	}
+}
+
+type benchName struct {
+	kind   string
+	bucket int
+}
+
+// parseBenchName splits "bench.KIND.BUCKET:..." lines.
+func parseBenchName(t *testing.T, line string) benchName {
+	parts := strings.Split(line[:strings.IndexByte(line, ':')], ".")
+	if len(parts) != 3 || parts[0] != "bench" {
+		t.Fatalf("unexpected line %q", line)
+	}
+	bucket, err := strconv.Atoi(parts[2])
+	if err != nil {
+		t.Fatalf("unexpected line %q", line)
+	}
+	return benchName{parts[1], bucket}
+}
+
+func TestReport(t *testing.T) {
+	saved := opts
+	defer func() { opts = saved }()
+	opts.ReceiveCounter = "statsdaemon.received"
+	opts.Postfix = ".local"
+
+	a := newTestSender(1)
+	a.count("bench.c.1:1|c")
+	a.count("bench.c.1:1|c")
+	a.count("bench.ms.1:3|ms")
+	a.count("bench.g.1:5|g")
+	a.packets = 2
+	b := newTestSender(1)
+	b.count("bench.c.2:1|c")
+	b.count("bench.g.2:8|g")
+	b.packets = 1
+
+	g := &fakeGraphite{lines: []string{
+		"stats.counters.bench.c.1.count.local 2 100",
+		"stats.counters.bench.c.1.rate.local 0.2 100",
+		"stats.bench.c.2_ps.local 0.1 100",
+		"stats.timers.bench.ms.1.count.local 1 100",
+		"stats.timers.bench.ms.1.mean.local 3 100",
+		"stats.gauges.bench.g.1.local 5 100",
+		"stats.gauges.bench.g.2.local 8 90",
+		"stats.gauges.bench.g.2.local 6 100",
+		"stats.statsdaemon.received.local 7 100",
+		"stats.statsdaemon.received_ps.local 0.7 100",
+		"not a graphite line",
+	}}
+
+	var out bytes.Buffer
+	report(&out, []*benchSender{a, b}, time.Second, "udp", g)
+	assert.Equal(t, `sent 6 lines in 3 packets over udp in 1s: 6 lines/s, 3 packets/s
+  counters 3, gauges 2, timers 1, sets 0
+daemon stats.statsdaemon.received.local: 7
+graphite received 11 lines
+  counters: sent 3, got 2 (33.33% missing)
+  timer counts: sent 1, got all of them
+  gauges: 1 of 2 buckets have the last value sent
+`, out.String())
+}
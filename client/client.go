@@ -0,0 +1,260 @@
+// Package client sends metrics to statsdaemon, or any statsd server, over
+// UDP, TCP or a unix datagram socket. Lines are encoded by
+// statsd.AppendLine, so they are exactly what statsdaemon's parser expects,
+// and batched into packets of up to MaxPacketSize bytes.
+package client
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bitly/statsdaemon/statsd"
+)
+
+// Options configures a Client. Start from DefaultOptions.
+type Options struct {
+	// Network is udp, tcp or unix (a datagram socket).
+	Network string
+	Address string
+	// Prefix is prepended to every bucket, e.g. "myapp.".
+	Prefix string
+	// Tags are added to every metric.
+	Tags []string
+	// MaxPacketSize bounds the datagrams sent, and should match the
+	// server's -max-udp-packet-size.
+	MaxPacketSize int
+	// FlushInterval is how often buffered lines are sent, or 0 to only send
+	// them when a packet is full and on Flush and Close.
+	FlushInterval time.Duration
+}
+
+func DefaultOptions() Options {
+	return Options{
+		Network:       "udp",
+		Address:       "127.0.0.1:8125",
+		MaxPacketSize: 1472,
+		FlushInterval: 100 * time.Millisecond,
+	}
+}
+
+// Client buffers metrics and sends them in batches. It is safe for
+// concurrent use.
+type Client struct {
+	opts   Options
+	conn   net.Conn
+	stream bool
+
+	mu   sync.Mutex
+	buf  []byte
+	line []byte
+	rng  *rand.Rand
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func New(opts Options) (*Client, error) {
+	network := opts.Network
+	switch network {
+	case "udp", "tcp":
+	case "unix":
+		network = "unixgram"
+	default:
+		return nil, errors.New("network must be udp, tcp or unix")
+	}
+	if opts.MaxPacketSize < 1 {
+		return nil, errors.New("max packet size must be positive")
+	}
+	conn, err := net.Dial(network, opts.Address)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		opts:   opts,
+		conn:   conn,
+		stream: network == "tcp",
+		rng:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if opts.FlushInterval > 0 {
+		go c.flushEvery(opts.FlushInterval)
+	} else {
+		close(c.done)
+	}
+	return c, nil
+}
+
+func (c *Client) flushEvery(interval time.Duration) {
+	defer close(c.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// like any datagram, a failed background send is lost
+			c.Flush()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// Count adds value to a counter, sampled at rate (1 for every call).
+func (c *Client) Count(bucket string, value float64, rate float32, tags ...string) error {
+	return c.sample(&statsd.Packet{Bucket: bucket, ValFlt: value, Modifier: "c", Sampling: rate, Tags: tags})
+}
+
+// Incr adds one to a counter.
+func (c *Client) Incr(bucket string, tags ...string) error {
+	return c.Count(bucket, 1, 1, tags...)
+}
+
+// Gauge sets a gauge. Negative values take two lines, as a leading sign
+// makes a gauge relative, which are sent in the same packet.
+func (c *Client) Gauge(bucket string, value float64, tags ...string) error {
+	if value < 0 {
+		return c.Send(
+			&statsd.Packet{Bucket: bucket, ValFlt: 0, Modifier: "g", Tags: tags},
+			&statsd.Packet{Bucket: bucket, ValFlt: -value, ValStr: "-", Modifier: "g", Tags: tags},
+		)
+	}
+	return c.Send(&statsd.Packet{Bucket: bucket, ValFlt: value, Modifier: "g", Tags: tags})
+}
+
+// GaugeDelta changes a gauge relative to its current value.
+func (c *Client) GaugeDelta(bucket string, delta float64, tags ...string) error {
+	p := &statsd.Packet{Bucket: bucket, ValFlt: delta, ValStr: "+", Modifier: "g", Tags: tags}
+	if delta < 0 {
+		p.ValFlt, p.ValStr = -delta, "-"
+	}
+	return c.Send(p)
+}
+
+// Timing records a duration, in milliseconds, sampled at rate.
+func (c *Client) Timing(bucket string, d time.Duration, rate float32, tags ...string) error {
+	ms := float64(d) / float64(time.Millisecond)
+	return c.sample(&statsd.Packet{Bucket: bucket, ValFlt: ms, Modifier: "ms", Sampling: rate, Tags: tags})
+}
+
+// Histogram records a DogStatsD histogram value, sampled at rate.
+func (c *Client) Histogram(bucket string, value float64, rate float32, tags ...string) error {
+	return c.sample(&statsd.Packet{Bucket: bucket, ValFlt: value, Modifier: "h", Sampling: rate, Tags: tags})
+}
+
+// Distribution records a DogStatsD distribution value, sampled at rate.
+func (c *Client) Distribution(bucket string, value float64, rate float32, tags ...string) error {
+	return c.sample(&statsd.Packet{Bucket: bucket, ValFlt: value, Modifier: "d", Sampling: rate, Tags: tags})
+}
+
+// Set adds member to a set.
+func (c *Client) Set(bucket string, member string, tags ...string) error {
+	return c.Send(&statsd.Packet{Bucket: bucket, ValStr: member, Modifier: "s", Tags: tags})
+}
+
+// sample sends p with probability p.Sampling.
+func (c *Client) sample(p *statsd.Packet) error {
+	if p.Sampling > 0 && p.Sampling < 1 {
+		c.mu.Lock()
+		skip := c.rng.Float32() >= p.Sampling
+		c.mu.Unlock()
+		if skip {
+			return nil
+		}
+	}
+	return c.Send(p)
+}
+
+// Send queues packets as they are, with the client's prefix and tags added:
+// their Sampling only marks them, they are not sampled again. Either all of
+// them are queued or, if one can't be encoded, none.
+func (c *Client) Send(packets ...*statsd.Packet) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	start := len(c.line)
+	var ends []int
+	for _, p := range packets {
+		q := *p
+		q.Bucket = c.opts.Prefix + p.Bucket
+		if len(c.opts.Tags) > 0 {
+			q.Tags = append(append([]string(nil), p.Tags...), c.opts.Tags...)
+		}
+		var err error
+		if c.line, err = statsd.AppendLine(c.line, &q); err != nil {
+			c.line = c.line[:start]
+			return err
+		}
+		ends = append(ends, len(c.line))
+	}
+
+	// lines sent together, like the two of a negative gauge, go in the same
+	// packet if they fit in one
+	var err error
+	if size := len(c.line) - start + len(ends) - 1; len(c.buf) > 0 && len(c.buf)+1+size > c.opts.MaxPacketSize {
+		err = c.flush()
+	}
+	for i, end := range ends {
+		line := c.line[start:end]
+		if i > 0 {
+			line = c.line[ends[i-1]:end]
+		}
+		if werr := c.appendLine(line); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	c.line = c.line[:start]
+	return err
+}
+
+// appendLine adds line to the packet being built, sending the packet first
+// if the line doesn't fit.
+func (c *Client) appendLine(line []byte) error {
+	var err error
+	if len(c.buf) > 0 && len(c.buf)+1+len(line) > c.opts.MaxPacketSize {
+		err = c.flush()
+	}
+	if len(c.buf) > 0 {
+		c.buf = append(c.buf, '\n')
+	}
+	c.buf = append(c.buf, line...)
+	return err
+}
+
+// Flush sends the buffered lines.
+func (c *Client) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.flush()
+}
+
+func (c *Client) flush() error {
+	if len(c.buf) == 0 {
+		return nil
+	}
+	if c.stream {
+		c.buf = append(c.buf, '\n')
+	}
+	_, err := c.conn.Write(c.buf)
+	c.buf = c.buf[:0]
+	return err
+}
+
+// Close sends the buffered lines and closes the connection. Calling it again
+// returns the first call's error.
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.stop)
+		<-c.done
+		c.closeErr = c.Flush()
+		if err := c.conn.Close(); c.closeErr == nil {
+			c.closeErr = err
+		}
+	})
+	return c.closeErr
+}
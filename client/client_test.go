@@ -0,0 +1,172 @@
+package client
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitly/statsdaemon/statsd"
+	"github.com/stretchr/testify/assert"
+)
+
+// listen returns a UDP listener and a function reading its next datagram.
+func listen(t *testing.T) (*net.UDPConn, func() string) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, func() string {
+		buf := make([]byte, 65536)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			return ""
+		}
+		return string(buf[:n])
+	}
+}
+
+func newTestClient(t *testing.T, address string, maxPacketSize int) *Client {
+	opts := DefaultOptions()
+	opts.Address = address
+	opts.MaxPacketSize = maxPacketSize
+	opts.FlushInterval = 0
+	c, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestClientRoundTrip(t *testing.T) {
+	conn, read := listen(t)
+	defer conn.Close()
+	c := newTestClient(t, conn.LocalAddr().String(), 1472)
+	defer c.Close()
+
+	assert.Equal(t, nil, c.Incr("gorets", "env:prod"))
+	assert.Equal(t, nil, c.Count("gorets", 3, 1))
+	assert.Equal(t, nil, c.Timing("glork", 320500*time.Microsecond, 1))
+	assert.Equal(t, nil, c.Gauge("gaugor", 333))
+	assert.Equal(t, nil, c.GaugeDelta("gaugor", -4))
+	assert.Equal(t, nil, c.Set("uniques", "765"))
+	assert.Equal(t, nil, c.Histogram("latency", 12, 1, "host:a"))
+	assert.Equal(t, nil, c.Distribution("size", 1.5, 1))
+	assert.Equal(t, nil, c.Send(&statsd.Packet{Bucket: "sampled", ValFlt: 1, Modifier: "c", Sampling: 0.1}))
+	assert.Equal(t, nil, c.Flush())
+
+	var got []*statsd.Packet
+	for _, line := range strings.Split(read(), "\n") {
+		got = append(got, statsd.ParseLine([]byte(line))...)
+	}
+	assert.Equal(t, []*statsd.Packet{
+		{Bucket: "gorets", ValFlt: 1, Modifier: "c", Sampling: 1, Tags: []string{"env:prod"}},
+		{Bucket: "gorets", ValFlt: 3, Modifier: "c", Sampling: 1},
+		{Bucket: "glork", ValFlt: 320.5, Modifier: "ms", Sampling: 1},
+		{Bucket: "gaugor", ValFlt: 333, Modifier: "g", Sampling: 1},
+		{Bucket: "gaugor", ValFlt: 4, ValStr: "-", Modifier: "g", Sampling: 1},
+		{Bucket: "uniques", ValStr: "765", Modifier: "s", Sampling: 1},
+		{Bucket: "latency", ValFlt: 12, Modifier: "h", Sampling: 1, Tags: []string{"host:a"}},
+		{Bucket: "size", ValFlt: 1.5, Modifier: "d", Sampling: 1},
+		{Bucket: "sampled", ValFlt: 1, Modifier: "c", Sampling: 0.1},
+	}, got)
+}
+
+func TestClientBatching(t *testing.T) {
+	conn, read := listen(t)
+	defer conn.Close()
+	c := newTestClient(t, conn.LocalAddr().String(), 40)
+	defer c.Close()
+
+	// "gorets:1|c" is 10 bytes, so three fit with their newlines
+	for i := 0; i < 7; i++ {
+		assert.Equal(t, nil, c.Incr("gorets"))
+	}
+	assert.Equal(t, nil, c.Flush())
+	for _, n := range []int{3, 3, 1} {
+		datagram := read()
+		assert.True(t, len(datagram) <= 40, datagram)
+		assert.Equal(t, n, len(strings.Split(datagram, "\n")))
+	}
+}
+
+func TestClientNegativeGaugeInOnePacket(t *testing.T) {
+	conn, read := listen(t)
+	defer conn.Close()
+	c := newTestClient(t, conn.LocalAddr().String(), 40)
+	defer c.Close()
+
+	// the first of the gauge's lines would still fit after the counters
+	assert.Equal(t, nil, c.Incr("gorets"))
+	assert.Equal(t, nil, c.Incr("gorets"))
+	assert.Equal(t, nil, c.Gauge("gaugor", -5))
+	assert.Equal(t, nil, c.Flush())
+	assert.Equal(t, "gorets:1|c\ngorets:1|c", read())
+	assert.Equal(t, "gaugor:0|g\ngaugor:-5|g", read())
+}
+
+func TestClientCloseTwice(t *testing.T) {
+	conn, read := listen(t)
+	defer conn.Close()
+	opts := DefaultOptions()
+	opts.Address = conn.LocalAddr().String()
+	c, err := New(opts)
+	assert.Equal(t, nil, err)
+
+	assert.Equal(t, nil, c.Incr("gorets"))
+	assert.Equal(t, nil, c.Close())
+	assert.Equal(t, "gorets:1|c", read())
+	assert.Equal(t, nil, c.Close())
+}
+
+func TestClientPrefixTagsAndGauges(t *testing.T) {
+	conn, read := listen(t)
+	defer conn.Close()
+	opts := DefaultOptions()
+	opts.Address = conn.LocalAddr().String()
+	opts.Prefix = "myapp."
+	opts.Tags = []string{"env:prod"}
+	c, err := New(opts)
+	assert.Equal(t, nil, err)
+
+	assert.Equal(t, nil, c.Gauge("gaugor", -5, "canary"))
+	// flushed in the background
+	assert.Equal(t, "myapp.gaugor:0|g|#canary,env:prod\nmyapp.gaugor:-5|g|#canary,env:prod", read())
+	assert.Equal(t, nil, c.Close())
+}
+
+func TestClientSampling(t *testing.T) {
+	conn, read := listen(t)
+	defer conn.Close()
+	c := newTestClient(t, conn.LocalAddr().String(), 65000)
+	defer c.Close()
+
+	for i := 0; i < 1000; i++ {
+		assert.Equal(t, nil, c.Count("gorets", 1, 0.1))
+	}
+	assert.Equal(t, nil, c.Flush())
+	n := len(strings.Split(read(), "\n"))
+	assert.True(t, n > 30 && n < 300, "%d of 1000 sent", n)
+}
+
+func TestClientInvalid(t *testing.T) {
+	conn, read := listen(t)
+	defer conn.Close()
+	c := newTestClient(t, conn.LocalAddr().String(), 1472)
+	defer c.Close()
+
+	assert.NotEqual(t, nil, c.Incr("my metric"))
+	assert.NotEqual(t, nil, c.Count("gorets", 1, 2))
+	// all or nothing
+	assert.NotEqual(t, nil, c.Send(
+		&statsd.Packet{Bucket: "gorets", ValFlt: 1, Modifier: "c"},
+		&statsd.Packet{Bucket: "uniques", Modifier: "s"},
+	))
+	assert.Equal(t, nil, c.Incr("glork"))
+	assert.Equal(t, nil, c.Flush())
+	assert.Equal(t, "glork:1|c", read())
+
+	_, err := New(Options{Network: "sctp", Address: "127.0.0.1:8125", MaxPacketSize: 1472})
+	assert.NotEqual(t, nil, err)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/bitly/statsdaemon/statsd"
+)
+
+// replay runs "statsdaemon replay [flags] FILE", which aggregates a
+// -record recording or a pcap of statsd traffic offline with the usual
+// aggregation flags and writes what would have been sent to graphite.
+func replay(args []string) {
+	output := flag.String("output", "-", "file to write the flushed metrics to (- for stdout)")
+	pcapPort := flag.Int("pcap-port", 8125, "UDP port of the statsd traffic in a pcap file (0 for any)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s replay [flags] RECORDING|PCAP\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.CommandLine.Parse(args)
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	input, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+	defer input.Close()
+	records, err := statsd.OpenRecords(input, *pcapPort)
+	if err != nil {
+		log.Fatalf("ERROR: %s - %s", flag.Arg(0), err)
+	}
+
+	out := os.Stdout
+	if *output != "-" {
+		out, err = os.Create(*output)
+		if err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+	}
+	w := bufio.NewWriter(out)
+	if err := statsd.Replay(opts, records, w); err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+	if err := out.Close(); err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/bitly/statsdaemon/client"
+	"github.com/bitly/statsdaemon/statsd"
+)
+
+// send runs "statsdaemon send [flags] -TYPE BUCKET VALUE...", which sends
+// one line per value to a statsd daemon through the client package.
+func send(args []string) {
+	types := []struct {
+		name, modifier, usage string
+	}{
+		{"c", "c", "send counter increments to `BUCKET`"},
+		{"g", "g", "send gauge values to `BUCKET` (+N and -N change it relative to the current value)"},
+		{"ms", "ms", "send timings to `BUCKET`"},
+		{"s", "s", "send set members to `BUCKET`"},
+		{"histogram", "h", "send DogStatsD histogram values to `BUCKET`"},
+		{"distribution", "d", "send DogStatsD distribution values to `BUCKET`"},
+	}
+	// none of the daemon's flags apply, except for the packet size
+	flags := flag.NewFlagSet("send", flag.ExitOnError)
+	buckets := make([]*string, len(types))
+	for i, t := range types {
+		buckets[i] = flags.String(t.name, "", t.usage)
+	}
+	flags.IntVar(&opts.MaxUdpPacketSize, "max-udp-packet-size", opts.MaxUdpPacketSize, "Maximum UDP packet size")
+	target := flags.String("target", "127.0.0.1:8125", "address (or unix socket path) of the statsd daemon")
+	protocol := flags.String("protocol", "udp", "how to send: udp, tcp or unix")
+	sampleRate := flags.Float64("sample-rate", 1, "sample rate of counters, timings, histograms and distributions (0-1)")
+	tags := flags.String("tags", "", "comma separated DogStatsD tags, e.g. env:prod,canary")
+	timestamp := flags.Int64("timestamp", 0, "DogStatsD client timestamp (unix seconds), if set")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s send [flags] -c|-g|-ms|-s|-histogram|-distribution BUCKET VALUE...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	var bucket, modifier string
+	for i, t := range types {
+		if *buckets[i] == "" {
+			continue
+		}
+		if bucket != "" {
+			log.Fatalf("ERROR: only one of -c, -g, -ms, -s, -histogram and -distribution may be given")
+		}
+		bucket, modifier = *buckets[i], t.modifier
+	}
+	if bucket == "" || flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var tagList []string
+	if *tags != "" {
+		tagList = strings.Split(*tags, ",")
+	}
+	var packets []*statsd.Packet
+	for _, value := range flags.Args() {
+		p := &statsd.Packet{
+			Bucket:    bucket,
+			Modifier:  modifier,
+			Sampling:  float32(*sampleRate),
+			Tags:      tagList,
+			Timestamp: *timestamp,
+		}
+		if err := setValue(p, value); err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+		packets = append(packets, p)
+	}
+	c, err := client.New(client.Options{
+		Network:       *protocol,
+		Address:       *target,
+		MaxPacketSize: opts.MaxUdpPacketSize,
+	})
+	if err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+	if err := c.Send(packets...); err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+	if err := c.Close(); err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+}
+
+// setValue sets the value of p from its command line form.
+func setValue(p *statsd.Packet, value string) error {
+	switch p.Modifier {
+	case "s":
+		p.ValStr = value
+		return nil
+	case "g":
+		if strings.HasPrefix(value, "+") || strings.HasPrefix(value, "-") {
+			p.ValStr, value = value[:1], value[1:]
+		}
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return fmt.Errorf("invalid value %q", value)
+	}
+	p.ValFlt = f
+	return nil
+}
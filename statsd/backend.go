@@ -0,0 +1,47 @@
+package statsd
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// Backend is where a window sends its metrics at each flush, written as
+// graphite plaintext lines ("name value timestamp\n").
+type Backend interface {
+	// Dial opens a connection for one flush. If it fails the window keeps
+	// its aggregates and tries again at the next flush.
+	Dial(deadline time.Time) (io.WriteCloser, error)
+	String() string
+}
+
+// GraphiteBackend sends metrics to a carbon plaintext listener over TCP.
+type GraphiteBackend struct {
+	Address string
+}
+
+// NewGraphiteBackend returns a GraphiteBackend for address, or nil for "-".
+func NewGraphiteBackend(address string) Backend {
+	if address == "-" {
+		return nil
+	}
+	return &GraphiteBackend{Address: address}
+}
+
+func (g *GraphiteBackend) Dial(deadline time.Time) (io.WriteCloser, error) {
+	dialer := &net.Dialer{Deadline: deadline}
+	client, err := dialer.Dial("tcp", g.Address)
+	if err != nil {
+		return nil, err
+	}
+	err = client.SetDeadline(deadline)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+func (g *GraphiteBackend) String() string {
+	return g.Address
+}
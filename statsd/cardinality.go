@@ -0,0 +1,88 @@
+package statsd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// CardinalityLimit caps the number of distinct buckets starting with prefix
+// that are accepted per flush interval. Limits are given as "PREFIX=N"; an
+// empty prefix applies to every bucket.
+type CardinalityLimit struct {
+	prefix string
+	limit  int
+	seen   map[string]bool
+	logged bool
+}
+
+type CardinalityLimits []*CardinalityLimit
+
+func (cl *CardinalityLimits) Set(s string) error {
+	i := strings.LastIndex(s, "=")
+	if i < 0 {
+		return fmt.Errorf("invalid cardinality limit %q (want PREFIX=N)", s)
+	}
+	limit, err := strconv.Atoi(s[i+1:])
+	if err != nil || limit < 1 {
+		return fmt.Errorf("invalid cardinality limit %q (want PREFIX=N)", s)
+	}
+	*cl = append(*cl, &CardinalityLimit{
+		prefix: s[:i],
+		limit:  limit,
+		seen:   make(map[string]bool),
+	})
+	return nil
+}
+
+func (cl *CardinalityLimits) String() string {
+	var limits []string
+	for _, l := range *cl {
+		limits = append(limits, l.prefix+"="+strconv.Itoa(l.limit))
+	}
+	return fmt.Sprintf("%v", limits)
+}
+
+// match returns the first limit whose prefix bucket starts with, or nil.
+func (cl CardinalityLimits) match(bucket string) *CardinalityLimit {
+	for _, l := range cl {
+		if strings.HasPrefix(bucket, l.prefix) {
+			return l
+		}
+	}
+	return nil
+}
+
+// admit records bucket as seen this interval, returning false if doing so
+// would exceed the limit.
+func (l *CardinalityLimit) admit(bucket string) bool {
+	if l.seen[bucket] {
+		return true
+	}
+	if len(l.seen) >= l.limit {
+		return false
+	}
+	l.seen[bucket] = true
+	return true
+}
+
+func (cl CardinalityLimits) reset() {
+	for _, l := range cl {
+		l.seen = make(map[string]bool)
+		l.logged = false
+	}
+}
+
+// clone returns the same limits with their own bookkeeping, so that servers
+// sharing Options don't share counts.
+func (cl CardinalityLimits) clone() CardinalityLimits {
+	var clone CardinalityLimits
+	for _, l := range cl {
+		clone = append(clone, &CardinalityLimit{
+			prefix: l.prefix,
+			limit:  l.limit,
+			seen:   make(map[string]bool),
+		})
+	}
+	return clone
+}
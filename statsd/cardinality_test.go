@@ -0,0 +1,36 @@
+package statsd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCardinalityLimitsSet(t *testing.T) {
+	var cl CardinalityLimits
+	assert.Equal(t, nil, cl.Set("servers.=2"))
+	assert.Equal(t, nil, cl.Set("=1000"))
+	assert.Equal(t, "[servers.=2 =1000]", cl.String())
+
+	assert.NotEqual(t, nil, cl.Set("servers."))
+	assert.NotEqual(t, nil, cl.Set("servers.=0"))
+	assert.NotEqual(t, nil, cl.Set("servers.=x"))
+}
+
+func TestCardinalityLimitsAdmit(t *testing.T) {
+	var cl CardinalityLimits
+	cl.Set("servers.=2")
+	cl.Set("=3")
+
+	l := cl.match("servers.a")
+	assert.Equal(t, cl[0], l)
+	assert.Equal(t, cl[1], cl.match("api.latency"))
+
+	assert.True(t, l.admit("servers.a"))
+	assert.True(t, l.admit("servers.b"))
+	assert.True(t, l.admit("servers.a"))
+	assert.False(t, l.admit("servers.c"))
+
+	cl.reset()
+	assert.True(t, l.admit("servers.c"))
+}
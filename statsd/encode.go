@@ -0,0 +1,100 @@
+package statsd
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// AppendLine appends the statsd line for the metric p to dst, without a
+// trailing newline:
+//
+//	bucket:value|type[|@sample_rate][|#tag,tag:value][|Ttimestamp]
+//
+// It is the inverse of ParseLine: the line parses back to p, with Sampling 1
+// when it was 0. Anything that would not, e.g. a bucket with characters the
+// parser drops or a set member containing '|', is an error. Note that an
+// absolute gauge can't be negative on the wire: a leading sign makes it
+// relative.
+func AppendLine(dst []byte, p *Packet) ([]byte, error) {
+	if p.Event != nil || p.ServiceCheck != nil {
+		return dst, fmt.Errorf("events and service checks can't be encoded")
+	}
+	if p.Bucket == "" {
+		return dst, fmt.Errorf("empty bucket")
+	}
+	if clean := sanitizeBucket([]byte(p.Bucket)); clean != p.Bucket {
+		return dst, fmt.Errorf("bucket %q would be received as %q", p.Bucket, clean)
+	}
+
+	var value string
+	switch p.Modifier {
+	case "c", "ms", "h", "d":
+		if p.ValStr != "" {
+			return dst, fmt.Errorf("unexpected string value %q for type %s", p.ValStr, p.Modifier)
+		}
+		if math.IsNaN(p.ValFlt) || math.IsInf(p.ValFlt, 0) {
+			return dst, fmt.Errorf("invalid value %v", p.ValFlt)
+		}
+		value = formatValue(p.ValFlt)
+	case "g":
+		if p.ValStr != "" && p.ValStr != "+" && p.ValStr != "-" {
+			return dst, fmt.Errorf("invalid gauge sign %q", p.ValStr)
+		}
+		if math.IsNaN(p.ValFlt) || math.IsInf(p.ValFlt, 0) {
+			return dst, fmt.Errorf("invalid value %v", p.ValFlt)
+		}
+		if p.ValStr == "" && p.ValFlt < 0 {
+			return dst, fmt.Errorf("negative gauge %v would be taken as a decrement", p.ValFlt)
+		}
+		value = p.ValStr + formatValue(p.ValFlt)
+	case "s":
+		if p.ValStr == "" || strings.ContainsAny(p.ValStr, "|\n") {
+			return dst, fmt.Errorf("invalid set member %q", p.ValStr)
+		}
+		value = p.ValStr
+	default:
+		return dst, fmt.Errorf("invalid type %q", p.Modifier)
+	}
+
+	if p.Sampling != 0 && p.Sampling != 1 {
+		if p.Modifier == "g" || p.Modifier == "s" {
+			return dst, fmt.Errorf("sample rate on type %s", p.Modifier)
+		}
+		if !(p.Sampling > 0 && p.Sampling < 1) {
+			return dst, fmt.Errorf("invalid sample rate %v", p.Sampling)
+		}
+	}
+	for _, tag := range p.Tags {
+		if tag == "" || strings.ContainsAny(tag, ",|\n") {
+			return dst, fmt.Errorf("invalid tag %q", tag)
+		}
+	}
+	if p.Timestamp < 0 {
+		return dst, fmt.Errorf("invalid timestamp %d", p.Timestamp)
+	}
+
+	dst = append(dst, p.Bucket...)
+	dst = append(dst, ':')
+	dst = append(dst, value...)
+	dst = append(dst, '|')
+	dst = append(dst, p.Modifier...)
+	if p.Sampling != 0 && p.Sampling != 1 {
+		dst = append(dst, "|@"...)
+		dst = strconv.AppendFloat(dst, float64(p.Sampling), 'g', -1, 32)
+	}
+	if len(p.Tags) > 0 {
+		dst = append(dst, "|#"...)
+		dst = append(dst, strings.Join(p.Tags, ",")...)
+	}
+	if p.Timestamp != 0 {
+		dst = append(dst, "|T"...)
+		dst = strconv.AppendInt(dst, p.Timestamp, 10)
+	}
+	return dst, nil
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
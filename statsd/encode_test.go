@@ -0,0 +1,59 @@
+package statsd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAppendLineRoundTrip(t *testing.T) {
+	packets := []*Packet{
+		{Bucket: "deploys.count", ValFlt: 1, Modifier: "c", Sampling: 1},
+		{Bucket: "gorets", ValFlt: -2.5, Modifier: "c", Sampling: 0.1},
+		{Bucket: "glork", ValFlt: 320.125, Modifier: "ms", Sampling: 0.25, Tags: []string{"env:prod", "canary"}},
+		{Bucket: "gaugor", ValFlt: 1e21, Modifier: "g", Sampling: 1},
+		{Bucket: "gaugor", ValFlt: 3, ValStr: "-", Modifier: "g", Sampling: 1, Timestamp: 1414141414},
+		{Bucket: "gaugor", ValFlt: 0.0001, ValStr: "+", Modifier: "g", Sampling: 1},
+		{Bucket: "uniques", ValStr: "user:1234", Modifier: "s", Sampling: 1, Tags: []string{"a"}},
+		{Bucket: "Some-Thing_2.x", ValFlt: 0, Modifier: "h", Sampling: 0.5},
+		{Bucket: "latency", ValFlt: 12, Modifier: "d", Sampling: 1, Tags: []string{"host:a:b"}, Timestamp: 1},
+	}
+	for _, p := range packets {
+		line, err := AppendLine(nil, p)
+		assert.Equal(t, nil, err)
+		parsed := ParseLine(line)
+		if assert.Equal(t, 1, len(parsed), string(line)) {
+			assert.Equal(t, p, parsed[0], string(line))
+		}
+	}
+
+	line, _ := AppendLine([]byte("x\n"), &Packet{Bucket: "gorets", ValFlt: 1, Modifier: "c"})
+	assert.Equal(t, "x\ngorets:1|c", string(line))
+	assert.Equal(t, float32(1), ParseLine(line[2:])[0].Sampling)
+
+	line, _ = AppendLine(nil, packets[2])
+	assert.Equal(t, "glork:320.125|ms|@0.25|#env:prod,canary", string(line))
+}
+
+func TestAppendLineInvalid(t *testing.T) {
+	for _, p := range []*Packet{
+		{Bucket: "", ValFlt: 1, Modifier: "c"},
+		{Bucket: "my metric", ValFlt: 1, Modifier: "c"},
+		{Bucket: "a:b", ValFlt: 1, Modifier: "c"},
+		{Bucket: "gorets", ValFlt: 1, Modifier: "x"},
+		{Bucket: "gorets", ValFlt: 1, ValStr: "1", Modifier: "c"},
+		{Bucket: "gaugor", ValFlt: -1, Modifier: "g"},
+		{Bucket: "gaugor", ValFlt: 1, Modifier: "g", Sampling: 0.5},
+		{Bucket: "glork", ValFlt: 1, Modifier: "ms", Sampling: 2},
+		{Bucket: "uniques", Modifier: "s"},
+		{Bucket: "uniques", ValStr: "a|b", Modifier: "s"},
+		{Bucket: "gorets", ValFlt: 1, Modifier: "c", Tags: []string{"a,b"}},
+		{Bucket: "gorets", ValFlt: 1, Modifier: "c", Tags: []string{""}},
+		{Bucket: "gorets", ValFlt: 1, Modifier: "c", Timestamp: -1},
+		{Modifier: "_e", Event: &Event{Title: "t", Text: "t"}},
+	} {
+		line, err := AppendLine([]byte("x"), p)
+		assert.NotEqual(t, nil, err, "%+v", p)
+		assert.Equal(t, "x", string(line))
+	}
+}
@@ -0,0 +1,299 @@
+package statsd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Event is a DogStatsD event:
+//
+//	_e{TITLE_LEN,TEXT_LEN}:TITLE|TEXT|d:TIMESTAMP|h:HOST|k:KEY|p:PRIORITY|s:SOURCE|t:ALERT_TYPE|#TAGS
+//
+// Newlines in TEXT are sent escaped as \n.
+type Event struct {
+	Title          string   `json:"title"`
+	Text           string   `json:"text"`
+	Timestamp      int64    `json:"timestamp,omitempty"`
+	Hostname       string   `json:"hostname,omitempty"`
+	AggregationKey string   `json:"aggregation_key,omitempty"`
+	Priority       string   `json:"priority,omitempty"`
+	SourceType     string   `json:"source_type_name,omitempty"`
+	AlertType      string   `json:"alert_type,omitempty"`
+	Tags           []string `json:"tags,omitempty"`
+}
+
+// ServiceCheck is a DogStatsD service check:
+//
+//	_sc|NAME|STATUS|d:TIMESTAMP|h:HOST|#TAGS|m:MESSAGE
+//
+// where STATUS is 0 (ok), 1 (warning), 2 (critical) or 3 (unknown).
+type ServiceCheck struct {
+	Name      string   `json:"name"`
+	Status    int      `json:"status"`
+	Timestamp int64    `json:"timestamp,omitempty"`
+	Hostname  string   `json:"hostname,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+	Message   string   `json:"message,omitempty"`
+}
+
+func isEventLine(line []byte) bool {
+	return bytes.HasPrefix(line, []byte("_e{")) || bytes.HasPrefix(line, []byte("_sc|"))
+}
+
+func parseEvent(line []byte) (*Event, error) {
+	end := bytes.IndexByte(line, '}')
+	if end < 0 || len(line) < end+2 || line[end+1] != ':' {
+		return nil, fmt.Errorf("missing {TITLE_LEN,TEXT_LEN}:")
+	}
+	lengths := strings.Split(string(line[len("_e{"):end]), ",")
+	if len(lengths) != 2 {
+		return nil, fmt.Errorf("missing {TITLE_LEN,TEXT_LEN}:")
+	}
+	titleLen, err := strconv.Atoi(lengths[0])
+	if err != nil || titleLen < 1 {
+		return nil, fmt.Errorf("invalid title length %q", lengths[0])
+	}
+	textLen, err := strconv.Atoi(lengths[1])
+	if err != nil || textLen < 0 {
+		return nil, fmt.Errorf("invalid text length %q", lengths[1])
+	}
+
+	// compared one at a time, as their sum may overflow
+	rest := line[end+2:]
+	if titleLen > len(rest) || textLen > len(rest)-titleLen-1 || rest[titleLen] != '|' {
+		return nil, fmt.Errorf("title and text don't match their lengths")
+	}
+	e := &Event{
+		Title: string(rest[:titleLen]),
+		Text:  strings.Replace(string(rest[titleLen+1:titleLen+1+textLen]), `\n`, "\n", -1),
+	}
+	rest = rest[titleLen+1+textLen:]
+	if len(rest) > 0 && rest[0] != '|' {
+		return nil, fmt.Errorf("title and text don't match their lengths")
+	}
+
+	for _, field := range bytes.Split(rest, []byte{'|'}) {
+		if len(field) == 0 {
+			continue
+		}
+		if field[0] == '#' {
+			e.Tags = parseTags(field[1:])
+			continue
+		}
+		if len(field) < 2 || field[1] != ':' {
+			continue
+		}
+		value := string(field[2:])
+		switch field[0] {
+		case 'd':
+			e.Timestamp, err = strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid timestamp %q", value)
+			}
+		case 'h':
+			e.Hostname = value
+		case 'k':
+			e.AggregationKey = value
+		case 'p':
+			e.Priority = value
+		case 's':
+			e.SourceType = value
+		case 't':
+			e.AlertType = value
+		}
+	}
+	return e, nil
+}
+
+func parseServiceCheck(line []byte) (*ServiceCheck, error) {
+	fields := bytes.Split(line, []byte{'|'})
+	if len(fields) < 3 || len(fields[1]) == 0 {
+		return nil, fmt.Errorf("want _sc|NAME|STATUS")
+	}
+	status, err := strconv.Atoi(string(fields[2]))
+	if err != nil || status < 0 || status > 3 {
+		return nil, fmt.Errorf("invalid status %q", fields[2])
+	}
+	sc := &ServiceCheck{Name: string(fields[1]), Status: status}
+
+	for i, field := range fields[3:] {
+		if len(field) == 0 {
+			continue
+		}
+		if field[0] == '#' {
+			sc.Tags = parseTags(field[1:])
+			continue
+		}
+		if len(field) < 2 || field[1] != ':' {
+			continue
+		}
+		value := string(field[2:])
+		switch field[0] {
+		case 'd':
+			sc.Timestamp, err = strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid timestamp %q", value)
+			}
+		case 'h':
+			sc.Hostname = value
+		case 'm':
+			// the message is always last and may itself contain '|'
+			sc.Message = string(bytes.Join(fields[3+i:], []byte{'|'})[2:])
+			return sc, nil
+		}
+	}
+	return sc, nil
+}
+
+func parseTags(tags []byte) []string {
+	var out []string
+	for _, tag := range strings.Split(string(tags), ",") {
+		if tag != "" {
+			out = append(out, tag)
+		}
+	}
+	return out
+}
+
+// EventSink delivers events and service checks somewhere outside statsdaemon.
+type EventSink interface {
+	SendEvent(e *Event) error
+	SendServiceCheck(sc *ServiceCheck) error
+}
+
+// EventSinks are given as "log", "graphite=URL" or "webhook=URL".
+type EventSinks []EventSink
+
+func (es *EventSinks) Set(s string) error {
+	kind, url := s, ""
+	if i := strings.Index(s, "="); i >= 0 {
+		kind, url = s[:i], s[i+1:]
+	}
+	switch {
+	case kind == "log" && url == "":
+		*es = append(*es, &logSink{})
+	case kind == "graphite" && url != "":
+		*es = append(*es, &graphiteEventSink{url: url})
+	case kind == "webhook" && url != "":
+		*es = append(*es, &webhookSink{url: url})
+	default:
+		return fmt.Errorf("invalid event sink %q (want log, graphite=URL or webhook=URL)", s)
+	}
+	return nil
+}
+
+func (es *EventSinks) String() string {
+	var sinks []string
+	for _, s := range *es {
+		sinks = append(sinks, fmt.Sprint(s))
+	}
+	return fmt.Sprintf("%v", sinks)
+}
+
+var eventClient = &http.Client{Timeout: 10 * time.Second}
+
+// postJSON sends v to url, treating anything but a 2xx response as failure.
+func postJSON(url string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	resp, err := eventClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("POST %s - %s", url, resp.Status)
+	}
+	return nil
+}
+
+// logSink logs events and service checks at info level, through the logger
+// the Server gives it.
+type logSink struct {
+	log *logger
+}
+
+func (*logSink) String() string { return "log" }
+
+func (l *logSink) SendEvent(e *Event) error {
+	l.log.log(LevelInfo, "events", "event", "title", e.Title, "text", e.Text, "tags", strings.Join(e.Tags, ","))
+	return nil
+}
+
+func (l *logSink) SendServiceCheck(sc *ServiceCheck) error {
+	l.log.log(LevelInfo, "events", "service check", "name", sc.Name, "status", sc.Status, "message", sc.Message,
+		"tags", strings.Join(sc.Tags, ","))
+	return nil
+}
+
+// graphiteEventSink posts events to graphite-web's /events/ API. Graphite has
+// nothing like service checks, so those are dropped.
+type graphiteEventSink struct {
+	url string
+}
+
+func (g *graphiteEventSink) String() string { return "graphite=" + g.url }
+
+func (g *graphiteEventSink) SendEvent(e *Event) error {
+	when := e.Timestamp
+	if when == 0 {
+		when = time.Now().Unix()
+	}
+	return postJSON(g.url, map[string]interface{}{
+		"what": e.Title,
+		"data": e.Text,
+		"tags": strings.Join(e.Tags, " "),
+		"when": when,
+	})
+}
+
+func (g *graphiteEventSink) SendServiceCheck(sc *ServiceCheck) error {
+	return nil
+}
+
+// webhookSink posts every event and service check as JSON, with a "type" of
+// "event" or "service_check" alongside the parsed fields.
+type webhookSink struct {
+	url string
+}
+
+func (w *webhookSink) String() string { return "webhook=" + w.url }
+
+func (w *webhookSink) SendEvent(e *Event) error {
+	return postJSON(w.url, struct {
+		Type string `json:"type"`
+		*Event
+	}{"event", e})
+}
+
+func (w *webhookSink) SendServiceCheck(sc *ServiceCheck) error {
+	return postJSON(w.url, struct {
+		Type string `json:"type"`
+		*ServiceCheck
+	}{"service_check", sc})
+}
+
+// sendEvents delivers everything queued on events to every sink, off the
+// monitor goroutine so that slow HTTP sinks don't hold up aggregation.
+func sendEvents(events <-chan *Packet, sinks EventSinks, l *logger) {
+	for p := range events {
+		for _, sink := range sinks {
+			var err error
+			if p.Event != nil {
+				err = sink.SendEvent(p.Event)
+			} else {
+				err = sink.SendServiceCheck(p.ServiceCheck)
+			}
+			if err != nil {
+				l.log(LevelError, "events", "sending to event sink failed", "sink", sink, "error", err)
+			}
+		}
+	}
+}
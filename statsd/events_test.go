@@ -0,0 +1,152 @@
+package statsd
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseEvent(t *testing.T) {
+	e, err := parseEvent([]byte(`_e{6,20}:deploy|api v1.2\nrolled out|d:1418052649|h:ci01|p:low|t:success|k:api|s:jenkins|#env:prod,team:web`))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "deploy", e.Title)
+	assert.Equal(t, "api v1.2\nrolled out", e.Text)
+	assert.Equal(t, int64(1418052649), e.Timestamp)
+	assert.Equal(t, "ci01", e.Hostname)
+	assert.Equal(t, "low", e.Priority)
+	assert.Equal(t, "success", e.AlertType)
+	assert.Equal(t, "api", e.AggregationKey)
+	assert.Equal(t, "jenkins", e.SourceType)
+	assert.Equal(t, []string{"env:prod", "team:web"}, e.Tags)
+
+	// the text may contain '|', which is why lengths are sent
+	e, err = parseEvent([]byte("_e{1,3}:a|b|c"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "b|c", e.Text)
+
+	e, err = parseEvent([]byte("_e{5,0}:empty|"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", e.Text)
+
+	for _, line := range []string{
+		"_e{5,4}:short|x",
+		"_e{1,1}:a|bc",
+		"_e{x,1}:a|b",
+		"_e{0,1}:|b",
+		"_e{1,1}a|b",
+		"_e{1,1}:a|b|d:now",
+		"_e{4611686018427387904,4611686018427387904}:a|b",
+		"_e{3,1}:abc",
+	} {
+		_, err = parseEvent([]byte(line))
+		assert.NotEqual(t, nil, err, line)
+	}
+}
+
+func TestParseServiceCheck(t *testing.T) {
+	sc, err := parseServiceCheck([]byte("_sc|api.health|2|d:1418052649|h:web01|#env:prod|m:down | 3 of 4 checks failed"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "api.health", sc.Name)
+	assert.Equal(t, 2, sc.Status)
+	assert.Equal(t, int64(1418052649), sc.Timestamp)
+	assert.Equal(t, "web01", sc.Hostname)
+	assert.Equal(t, []string{"env:prod"}, sc.Tags)
+	assert.Equal(t, "down | 3 of 4 checks failed", sc.Message)
+
+	for _, line := range []string{"_sc|api.health", "_sc||0", "_sc|api.health|4", "_sc|api.health|ok"} {
+		_, err = parseServiceCheck([]byte(line))
+		assert.NotEqual(t, nil, err, line)
+	}
+}
+
+func TestParseLineEvent(t *testing.T) {
+	packet := ParseLine([]byte("_e{6,2}:deploy|ok"))[0]
+	assert.NotEqual(t, packet, nil)
+	assert.Equal(t, "_e", packet.Modifier)
+	assert.Equal(t, "deploy", packet.Event.Title)
+
+	packet = ParseLine([]byte("_sc|api.health|0"))[0]
+	assert.NotEqual(t, packet, nil)
+	assert.Equal(t, "_sc", packet.Modifier)
+	assert.Equal(t, "api.health", packet.ServiceCheck.Name)
+
+	if len(ParseLine([]byte("_sc|api.health"))) != 0 {
+		t.Fail()
+	}
+}
+
+func TestEventSinksSet(t *testing.T) {
+	var es EventSinks
+	assert.Equal(t, nil, es.Set("log"))
+	assert.Equal(t, nil, es.Set("graphite=http://graphite/events/"))
+	assert.Equal(t, nil, es.Set("webhook=http://hooks/statsd"))
+	assert.Equal(t, "[log graphite=http://graphite/events/ webhook=http://hooks/statsd]", es.String())
+
+	assert.NotEqual(t, nil, es.Set("graphite"))
+	assert.NotEqual(t, nil, es.Set("log=foo"))
+	assert.NotEqual(t, nil, es.Set("kafka=broker:9092"))
+}
+
+func TestLogSinkPerServer(t *testing.T) {
+	var first, second bytes.Buffer
+	opts := DefaultOptions()
+	opts.EventSinks.Set("log")
+	opts.LogOutput = &first
+	s1 := newTestServer(t, opts)
+	opts.LogOutput = &second
+	s2 := newTestServer(t, opts)
+
+	assert.Equal(t, nil, s1.opts.EventSinks[0].SendEvent(&Event{Title: "deploy", Text: "api"}))
+	assert.Contains(t, first.String(), "INFO: events: event title=deploy text=api")
+	assert.Equal(t, "", second.String())
+	assert.Equal(t, nil, s2.opts.EventSinks[0].SendEvent(&Event{Title: "deploy", Text: "web"}))
+	assert.Contains(t, second.String(), "text=web")
+	assert.Nil(t, opts.EventSinks[0].(*logSink).log)
+}
+
+func TestEventHTTPSinks(t *testing.T) {
+	bodies := make(chan map[string]interface{}, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var v map[string]interface{}
+		json.Unmarshal(body, &v)
+		bodies <- v
+	}))
+	defer server.Close()
+
+	e := &Event{Title: "deploy", Text: "api v1.2", Timestamp: 1418052649, Tags: []string{"env:prod", "api"}}
+	sc := &ServiceCheck{Name: "api.health", Status: 1}
+
+	graphite := &graphiteEventSink{url: server.URL}
+	assert.Equal(t, nil, graphite.SendEvent(e))
+	assert.Equal(t, nil, graphite.SendServiceCheck(sc))
+	v := <-bodies
+	assert.Equal(t, "deploy", v["what"])
+	assert.Equal(t, "api v1.2", v["data"])
+	assert.Equal(t, "env:prod api", v["tags"])
+	assert.Equal(t, float64(1418052649), v["when"])
+	assert.Equal(t, 0, len(bodies))
+
+	webhook := &webhookSink{url: server.URL}
+	assert.Equal(t, nil, webhook.SendEvent(e))
+	v = <-bodies
+	assert.Equal(t, "event", v["type"])
+	assert.Equal(t, "deploy", v["title"])
+	assert.Equal(t, nil, webhook.SendServiceCheck(sc))
+	v = <-bodies
+	assert.Equal(t, "service_check", v["type"])
+	assert.Equal(t, "api.health", v["name"])
+	assert.Equal(t, float64(1), v["status"])
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	webhook = &webhookSink{url: failing.URL}
+	assert.NotEqual(t, nil, webhook.SendEvent(e))
+}
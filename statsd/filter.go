@@ -0,0 +1,107 @@
+package statsd
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// FilterRule allows or denies packets whose bucket matches a glob or a
+// regular expression, optionally only for some metric types.
+//
+// Rules are given as "ACTION KIND PATTERN [TYPES]", e.g.
+//
+//	deny glob servers.*.debug.*
+//	allow regex ^api\.(latency|errors)$ ms,c
+//
+// where ACTION is allow or deny, KIND is glob or regex and TYPES is a comma
+// separated list of type codes (c, g, ms, s, h, d). Globs use path.Match syntax, so
+// * also matches dots.
+type FilterRule struct {
+	rule   string
+	allow  bool
+	glob   string
+	regexp *regexp.Regexp
+	types  map[string]bool
+	name   string // used for the -filter-counter self-metric
+}
+
+type FilterRules []*FilterRule
+
+func (fr *FilterRules) Set(s string) error {
+	fields := strings.Fields(s)
+	if len(fields) != 3 && len(fields) != 4 {
+		return fmt.Errorf("invalid filter rule %q (want ACTION KIND PATTERN [TYPES])", s)
+	}
+
+	r := &FilterRule{rule: s}
+	switch fields[0] {
+	case "allow":
+		r.allow = true
+	case "deny":
+	default:
+		return fmt.Errorf("invalid filter action %q", fields[0])
+	}
+
+	switch fields[1] {
+	case "glob":
+		if _, err := path.Match(fields[2], ""); err != nil {
+			return fmt.Errorf("invalid filter glob %q - %s", fields[2], err)
+		}
+		r.glob = fields[2]
+	case "regex":
+		re, err := regexp.Compile(fields[2])
+		if err != nil {
+			return fmt.Errorf("invalid filter regex %q - %s", fields[2], err)
+		}
+		r.regexp = re
+	default:
+		return fmt.Errorf("invalid filter kind %q", fields[1])
+	}
+
+	if len(fields) == 4 {
+		r.types = make(map[string]bool)
+		for _, t := range strings.Split(fields[3], ",") {
+			switch t {
+			case "c", "g", "ms", "s", "h", "d":
+				r.types[t] = true
+			default:
+				return fmt.Errorf("invalid filter type %q", t)
+			}
+		}
+	}
+
+	r.name = fmt.Sprintf("rule%d", len(*fr)+1)
+	*fr = append(*fr, r)
+	return nil
+}
+
+func (fr *FilterRules) String() string {
+	var rules []string
+	for _, r := range *fr {
+		rules = append(rules, r.rule)
+	}
+	return fmt.Sprintf("%v", rules)
+}
+
+func (r *FilterRule) matches(p *Packet) bool {
+	if r.types != nil && !r.types[p.Modifier] {
+		return false
+	}
+	if r.regexp != nil {
+		return r.regexp.MatchString(p.Bucket)
+	}
+	ok, _ := path.Match(r.glob, p.Bucket)
+	return ok
+}
+
+// match returns the first rule matching p, or nil if none does.
+func (fr FilterRules) match(p *Packet) *FilterRule {
+	for _, r := range fr {
+		if r.matches(p) {
+			return r
+		}
+	}
+	return nil
+}
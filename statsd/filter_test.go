@@ -0,0 +1,40 @@
+package statsd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterRulesSet(t *testing.T) {
+	var fr FilterRules
+	assert.Equal(t, nil, fr.Set("deny glob servers.*.debug"))
+	assert.Equal(t, nil, fr.Set(`allow regex ^api\. ms,c`))
+	assert.Equal(t, 2, len(fr))
+	assert.Equal(t, "rule2", fr[1].name)
+
+	assert.NotEqual(t, nil, fr.Set("deny glob"))
+	assert.NotEqual(t, nil, fr.Set("drop glob foo"))
+	assert.NotEqual(t, nil, fr.Set("deny prefix foo"))
+	assert.NotEqual(t, nil, fr.Set("deny glob [foo"))
+	assert.NotEqual(t, nil, fr.Set("deny regex (foo"))
+	assert.NotEqual(t, nil, fr.Set("deny glob foo c,x"))
+	assert.Equal(t, 2, len(fr))
+}
+
+func TestFilterRulesMatch(t *testing.T) {
+	var fr FilterRules
+	fr.Set(`allow regex ^api\.debug\. ms`)
+	fr.Set("deny glob *.debug.*")
+	fr.Set("deny glob tmp.* g")
+
+	match := func(bucket, modifier string) *FilterRule {
+		return fr.match(&Packet{Bucket: bucket, Modifier: modifier})
+	}
+	assert.Equal(t, fr[0], match("api.debug.latency", "ms"))
+	assert.Equal(t, fr[1], match("api.debug.latency", "c"))
+	assert.Equal(t, fr[1], match("servers.host1.debug.x", "c"))
+	assert.Equal(t, fr[2], match("tmp.x", "g"))
+	assert.Nil(t, match("tmp.x", "c"))
+	assert.Nil(t, match("api.latency", "ms"))
+}
@@ -0,0 +1,119 @@
+package statsd
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+const (
+	minHLLPrecision = 4
+	maxHLLPrecision = 18
+)
+
+// HyperLogLog estimates the number of distinct strings added to it in
+// constant memory: 2^precision one-byte registers, with a standard error of
+// about 1.04/sqrt(2^precision). Small cardinalities fall back to linear
+// counting, which is close to exact while most registers are still empty.
+//
+// Sketches with the same precision can be merged, which gives the estimate
+// for the union of both sets.
+type HyperLogLog struct {
+	precision uint8
+	registers []uint8
+}
+
+// NewHyperLogLog returns an empty sketch. precision must be between
+// minHLLPrecision and maxHLLPrecision.
+func NewHyperLogLog(precision uint8) *HyperLogLog {
+	return &HyperLogLog{
+		precision: precision,
+		registers: make([]uint8, 1<<precision),
+	}
+}
+
+func (h *HyperLogLog) Add(member string) {
+	x := hashMember(member)
+	idx := x >> (64 - h.precision)
+	rank := uint8(bits.LeadingZeros64(x<<h.precision|1<<(h.precision-1)) + 1)
+	if rank > h.registers[idx] {
+		h.registers[idx] = rank
+	}
+}
+
+// hashMember is 64-bit FNV-1a followed by the murmur3 finalizer, so that
+// short, similar members still spread over all registers. It has to be stable
+// across processes for merged sketches to agree.
+func hashMember(member string) uint64 {
+	f := fnv.New64a()
+	f.Write([]byte(member))
+	x := f.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func (h *HyperLogLog) Count() uint64 {
+	m := float64(len(h.registers))
+	var sum float64
+	var zeros int
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	var alpha float64
+	switch len(h.registers) {
+	case 16:
+		alpha = 0.673
+	case 32:
+		alpha = 0.697
+	case 64:
+		alpha = 0.709
+	default:
+		alpha = 0.7213 / (1 + 1.079/m)
+	}
+
+	estimate := alpha * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(estimate + 0.5)
+}
+
+func (h *HyperLogLog) Merge(other *HyperLogLog) error {
+	if h.precision != other.precision {
+		return errors.New("hyperloglog: precision mismatch")
+	}
+	for i, r := range other.registers {
+		if r > h.registers[i] {
+			h.registers[i] = r
+		}
+	}
+	return nil
+}
+
+// MarshalBinary encodes the sketch so that it can be shipped to another
+// daemon and merged there.
+func (h *HyperLogLog) MarshalBinary() ([]byte, error) {
+	return append([]byte{h.precision}, h.registers...), nil
+}
+
+func (h *HyperLogLog) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 {
+		return errors.New("hyperloglog: short buffer")
+	}
+	precision := data[0]
+	if precision < minHLLPrecision || precision > maxHLLPrecision || len(data)-1 != 1<<precision {
+		return errors.New("hyperloglog: invalid encoding")
+	}
+	h.precision = precision
+	h.registers = append([]uint8(nil), data[1:]...)
+	return nil
+}
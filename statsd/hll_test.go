@@ -0,0 +1,53 @@
+package statsd
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHyperLogLogCount(t *testing.T) {
+	h := NewHyperLogLog(14)
+	assert.Equal(t, uint64(0), h.Count())
+
+	for i := 0; i < 10; i++ {
+		h.Add("user" + strconv.Itoa(i))
+		h.Add("user" + strconv.Itoa(i))
+	}
+	assert.Equal(t, uint64(10), h.Count())
+
+	for i := 0; i < 1000000; i++ {
+		h.Add("user" + strconv.Itoa(i))
+	}
+	assert.InEpsilon(t, 1000000, float64(h.Count()), 0.03)
+}
+
+func TestHyperLogLogMerge(t *testing.T) {
+	a := NewHyperLogLog(12)
+	b := NewHyperLogLog(12)
+	for i := 0; i < 20000; i++ {
+		a.Add(strconv.Itoa(i))
+		b.Add(strconv.Itoa(i + 10000))
+	}
+	assert.Equal(t, nil, a.Merge(b))
+	assert.InEpsilon(t, 30000, float64(a.Count()), 0.05)
+
+	assert.NotEqual(t, nil, a.Merge(NewHyperLogLog(10)))
+}
+
+func TestHyperLogLogMarshalBinary(t *testing.T) {
+	h := NewHyperLogLog(10)
+	for i := 0; i < 5000; i++ {
+		h.Add(strconv.Itoa(i))
+	}
+	data, err := h.MarshalBinary()
+	assert.Equal(t, nil, err)
+
+	decoded := &HyperLogLog{}
+	assert.Equal(t, nil, decoded.UnmarshalBinary(data))
+	assert.Equal(t, h.Count(), decoded.Count())
+
+	assert.NotEqual(t, nil, decoded.UnmarshalBinary(data[:100]))
+	assert.NotEqual(t, nil, decoded.UnmarshalBinary(nil))
+}
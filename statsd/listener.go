@@ -0,0 +1,204 @@
+package statsd
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Listener feeds a Server, typically by passing the connections it accepts
+// to Server.ParseFrom.
+type Listener interface {
+	// Listen opens the listener and starts serving s in the background.
+	Listen(s *Server) error
+	// Close stops accepting input and returns once everything already
+	// received has been passed to the server.
+	Close() error
+}
+
+// drainTimeout is how long a closing listener keeps reading what its
+// connections have already received.
+const drainTimeout = 250 * time.Millisecond
+
+// UDPListener receives datagrams of newline separated lines.
+type UDPListener struct {
+	Address string
+	conn    *net.UDPConn
+	done    chan struct{}
+}
+
+func (l *UDPListener) Listen(s *Server) error {
+	address, _ := net.ResolveUDPAddr("udp", l.Address)
+	s.log.log(LevelInfo, "listener", "listening", "network", "udp", "address", address)
+	conn, err := net.ListenUDP("udp", address)
+	if err != nil {
+		return fmt.Errorf("ListenUDP - %s", err)
+	}
+	l.conn = conn
+	l.done = make(chan struct{})
+	go func() {
+		s.ParseFrom(conn, false)
+		close(l.done)
+	}()
+	return nil
+}
+
+// Close reads the datagrams queued on the socket before closing it.
+func (l *UDPListener) Close() error {
+	err := l.conn.SetReadDeadline(time.Now().Add(drainTimeout))
+	<-l.done
+	return err
+}
+
+// UnixListener receives datagrams of newline separated lines on a unix
+// domain socket, like the DogStatsD agent's.
+type UnixListener struct {
+	Path string
+	conn *net.UnixConn
+	done chan struct{}
+}
+
+func (l *UnixListener) Listen(s *Server) error {
+	// a socket left behind by a previous run would fail the bind
+	if fi, err := os.Stat(l.Path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(l.Path)
+	}
+	s.log.log(LevelInfo, "listener", "listening", "network", "unixgram", "address", l.Path)
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: l.Path, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("ListenUnixgram - %s", err)
+	}
+	l.conn = conn
+	l.done = make(chan struct{})
+	go func() {
+		s.ParseFrom(conn, false)
+		close(l.done)
+	}()
+	return nil
+}
+
+// Close reads the datagrams queued on the socket before closing and
+// removing it.
+func (l *UnixListener) Close() error {
+	err := l.conn.SetReadDeadline(time.Now().Add(drainTimeout))
+	<-l.done
+	if rerr := os.Remove(l.Path); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// TCPListener accepts streams of newline separated lines.
+type TCPListener struct {
+	Address  string
+	listener *net.TCPListener
+	closed   chan struct{}
+
+	// conns are the open connections, wg their ParseFrom goroutines and
+	// the accept loop
+	mu    sync.Mutex
+	conns map[*net.TCPConn]struct{}
+	wg    sync.WaitGroup
+}
+
+func (l *TCPListener) Listen(s *Server) error {
+	address, _ := net.ResolveTCPAddr("tcp", l.Address)
+	s.log.log(LevelInfo, "listener", "listening", "network", "tcp", "address", address)
+	listener, err := net.ListenTCP("tcp", address)
+	if err != nil {
+		return fmt.Errorf("ListenTCP - %s", err)
+	}
+	l.listener = listener
+	l.closed = make(chan struct{})
+	l.conns = make(map[*net.TCPConn]struct{})
+	l.wg.Add(1)
+	go l.accept(s)
+	return nil
+}
+
+func (l *TCPListener) accept(s *Server) {
+	defer l.wg.Done()
+	for {
+		conn, err := l.listener.AcceptTCP()
+		if err != nil {
+			select {
+			case <-l.closed:
+			default:
+				s.log.log(LevelError, "listener", "accept failed", "error", err)
+			}
+			return
+		}
+
+		l.mu.Lock()
+		select {
+		case <-l.closed:
+			conn.SetReadDeadline(time.Now().Add(drainTimeout))
+		default:
+		}
+		l.conns[conn] = struct{}{}
+		l.wg.Add(1)
+		l.mu.Unlock()
+
+		go func() {
+			defer l.wg.Done()
+			s.ParseFrom(conn, true)
+			l.mu.Lock()
+			delete(l.conns, conn)
+			l.mu.Unlock()
+		}()
+	}
+}
+
+// Close stops accepting connections and reads what the open ones have
+// already sent before closing them.
+func (l *TCPListener) Close() error {
+	l.mu.Lock()
+	close(l.closed)
+	for conn := range l.conns {
+		conn.SetReadDeadline(time.Now().Add(drainTimeout))
+	}
+	l.mu.Unlock()
+	err := l.listener.Close()
+	l.wg.Wait()
+	return err
+}
+
+// ParseFrom reads lines from conn until it fails or is closed, queueing each
+// packet for aggregation. partialReads is for streams, where lines may span
+// reads; otherwise each read is taken to be a datagram of whole lines.
+func (s *Server) ParseFrom(conn io.ReadCloser, partialReads bool) {
+	defer conn.Close()
+
+	var reader io.Reader = conn
+	source := func() string { return "" }
+	// the parser logs the source of bad lines
+	if s.sourceLimits != nil || s.recorder != nil || s.log.enabled(LevelError, "parser") {
+		switch c := conn.(type) {
+		case *net.UDPConn:
+			r := &udpSourceReader{conn: c}
+			reader, source = r, r.source
+		case net.Conn:
+			host := remoteHost(c.RemoteAddr())
+			source = func() string { return host }
+		}
+	}
+
+	parser := NewParser(reader, partialReads, s.opts.MaxUdpPacketSize)
+	parser.log, parser.source = s.log, source
+	if s.recorder != nil {
+		parser.record = func(line []byte) { s.recorder.Record(source(), line) }
+	}
+	for {
+		p, more := parser.Next()
+		if p != nil && (s.sourceLimits == nil || s.sourceLimits.allow(source(), time.Now())) {
+			s.in <- p
+		}
+
+		if !more {
+			break
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package statsd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Level is the severity of a log message.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarning
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warning", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return strconv.Itoa(int(l))
+	}
+	return levelNames[l]
+}
+
+func parseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if s == name {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q (want one of %s)", s, strings.Join(levelNames, ", "))
+}
+
+// LogSubsystems are the parts of the server that log, each of which may be
+// given its own level.
+var LogSubsystems = []string{"admin", "events", "flush", "listener", "parser", "record", "server", "state"}
+
+// LogLevels is the lowest level logged by each subsystem, set from a comma
+// separated default level and SUBSYSTEM=LEVEL overrides, e.g.
+// "warning,flush=info,parser=error".
+type LogLevels struct {
+	Default    Level
+	Subsystems map[string]Level
+}
+
+func (l *LogLevels) String() string {
+	if l == nil {
+		return ""
+	}
+	parts := []string{l.Default.String()}
+	for subsystem, level := range l.Subsystems {
+		parts = append(parts, subsystem+"="+level.String())
+	}
+	sort.Strings(parts[1:])
+	return strings.Join(parts, ",")
+}
+
+func (l *LogLevels) Set(s string) error {
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		eq := strings.IndexByte(part, '=')
+		if eq < 0 {
+			level, err := parseLevel(part)
+			if err != nil {
+				return err
+			}
+			l.Default = level
+			continue
+		}
+		subsystem := part[:eq]
+		if !isLogSubsystem(subsystem) {
+			return fmt.Errorf("unknown log subsystem %q (want one of %s)", subsystem, strings.Join(LogSubsystems, ", "))
+		}
+		level, err := parseLevel(part[eq+1:])
+		if err != nil {
+			return err
+		}
+		if l.Subsystems == nil {
+			l.Subsystems = make(map[string]Level)
+		}
+		l.Subsystems[subsystem] = level
+	}
+	return nil
+}
+
+func (l LogLevels) level(subsystem string) Level {
+	if level, ok := l.Subsystems[subsystem]; ok {
+		return level
+	}
+	return l.Default
+}
+
+func isLogSubsystem(s string) bool {
+	for _, subsystem := range LogSubsystems {
+		if s == subsystem {
+			return true
+		}
+	}
+	return false
+}
+
+// logger writes structured messages, a constant message with key value
+// pairs, as text or JSON lines. Warnings and errors are rate limited to
+// rateLimit a minute for each subsystem and message; how many more there
+// were is logged once the minute is up. A nil logger discards everything.
+type logger struct {
+	mu        sync.Mutex
+	out       io.Writer
+	json      bool
+	levels    LogLevels
+	rateLimit int
+	counts    map[logKey]*logCount
+	now       func() time.Time
+}
+
+type logKey struct {
+	subsystem, msg string
+}
+
+type logCount struct {
+	level      Level
+	start      time.Time
+	n          int
+	suppressed int
+}
+
+const logRatePeriod = time.Minute
+
+func newLogger(opts *Options) *logger {
+	l := &logger{
+		out:       opts.LogOutput,
+		json:      opts.LogFormat == "json",
+		rateLimit: opts.LogRateLimit,
+		counts:    make(map[logKey]*logCount),
+		now:       time.Now,
+	}
+	if l.out == nil {
+		l.out = os.Stderr
+	}
+	l.levels.Default = opts.LogLevels.Default
+	l.levels.Subsystems = make(map[string]Level)
+	for subsystem, level := range opts.LogLevels.Subsystems {
+		l.levels.Subsystems[subsystem] = level
+	}
+	// -debug has always printed what is sent to graphite
+	if _, ok := l.levels.Subsystems["flush"]; opts.Debug && !ok {
+		l.levels.Subsystems["flush"] = LevelDebug
+	}
+	return l
+}
+
+func (l *logger) enabled(level Level, subsystem string) bool {
+	return l != nil && level >= l.levels.level(subsystem)
+}
+
+// log writes msg with the key value pairs in kv, unless it is below the
+// subsystem's level or over the rate limit.
+func (l *logger) log(level Level, subsystem, msg string, kv ...interface{}) {
+	if !l.enabled(level, subsystem) {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if level >= LevelWarning && l.rateLimit > 0 {
+		key := logKey{subsystem, msg}
+		c := l.counts[key]
+		if c != nil && now.Sub(c.start) >= logRatePeriod {
+			l.writeSuppressed(now, key, c)
+			c = nil
+		}
+		if c == nil {
+			c = &logCount{level: level, start: now}
+			l.counts[key] = c
+		}
+		if c.n >= l.rateLimit {
+			c.suppressed++
+			return
+		}
+		c.n++
+	}
+	l.write(now, level, subsystem, msg, kv)
+}
+
+// reportSuppressed logs how many messages were dropped by the rate limit in
+// each minute that has ended, or in every minute if all is set, so that a
+// flood which stopped isn't forgotten.
+func (l *logger) reportSuppressed(all bool) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	for key, c := range l.counts {
+		if all || now.Sub(c.start) >= logRatePeriod {
+			l.writeSuppressed(now, key, c)
+			delete(l.counts, key)
+		}
+	}
+}
+
+func (l *logger) writeSuppressed(now time.Time, key logKey, c *logCount) {
+	if c.suppressed > 0 {
+		l.write(now, c.level, key.subsystem, "suppressed repeated messages",
+			[]interface{}{"msg", key.msg, "count", c.suppressed, "since", c.start})
+	}
+}
+
+func (l *logger) write(now time.Time, level Level, subsystem, msg string, kv []interface{}) {
+	var b []byte
+	if l.json {
+		b = append(b, `{"time":`...)
+		b = appendJSON(b, now.Format(time.RFC3339Nano))
+		b = append(b, `,"level":`...)
+		b = appendJSON(b, level.String())
+		b = append(b, `,"subsystem":`...)
+		b = appendJSON(b, subsystem)
+		b = append(b, `,"msg":`...)
+		b = appendJSON(b, msg)
+		for i := 0; i+1 < len(kv); i += 2 {
+			b = append(b, ',')
+			b = appendJSON(b, fmt.Sprint(kv[i]))
+			b = append(b, ':')
+			b = appendJSON(b, logValue(kv[i+1]))
+		}
+		b = append(b, "}\n"...)
+	} else {
+		b = append(b, now.Format("2006/01/02 15:04:05 ")...)
+		b = append(b, strings.ToUpper(level.String())...)
+		b = append(b, ": "...)
+		b = append(b, subsystem...)
+		b = append(b, ": "...)
+		b = append(b, msg...)
+		for i := 0; i+1 < len(kv); i += 2 {
+			b = append(b, ' ')
+			b = append(b, fmt.Sprint(kv[i])...)
+			b = append(b, '=')
+			b = appendText(b, logValue(kv[i+1]))
+		}
+		b = append(b, '\n')
+	}
+	l.out.Write(b)
+}
+
+// logValue converts v to something that prints or marshals readably.
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case time.Time:
+		return v.Format(time.RFC3339)
+	case fmt.Stringer:
+		return v.String()
+	case []byte:
+		return string(v)
+	}
+	return v
+}
+
+func appendJSON(b []byte, v interface{}) []byte {
+	j, err := json.Marshal(v)
+	if err != nil {
+		j, _ = json.Marshal(fmt.Sprint(v))
+	}
+	return append(b, j...)
+}
+
+// appendText appends v, quoted if it would be ambiguous unquoted.
+func appendText(b []byte, v interface{}) []byte {
+	s := fmt.Sprint(v)
+	if s == "" || strings.IndexFunc(s, func(r rune) bool {
+		return r == '"' || r == '=' || unicode.IsSpace(r) || !unicode.IsPrint(r)
+	}) >= 0 {
+		return strconv.AppendQuote(b, s)
+	}
+	return append(b, s...)
+}
@@ -0,0 +1,125 @@
+package statsd
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogLevels(t *testing.T) {
+	var l LogLevels
+	assert.Equal(t, nil, l.Set("warning,parser=error,flush=debug"))
+	assert.Equal(t, LevelWarning, l.level("server"))
+	assert.Equal(t, LevelError, l.level("parser"))
+	assert.Equal(t, LevelDebug, l.level("flush"))
+	assert.Equal(t, "warning,flush=debug,parser=error", l.String())
+
+	for _, s := range []string{"verbose", "parser=loud", "bogus=info", ""} {
+		assert.NotEqual(t, nil, l.Set(s), s)
+	}
+}
+
+func newTestLogger(opts Options) (*logger, *bytes.Buffer, *time.Time) {
+	var out bytes.Buffer
+	opts.LogOutput = &out
+	l := newLogger(&opts)
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+	return l, &out, &now
+}
+
+func TestLoggerText(t *testing.T) {
+	opts := DefaultOptions()
+	opts.LogLevels.Set("info,parser=error")
+	l, out, _ := newTestLogger(opts)
+
+	l.log(LevelInfo, "flush", "sent stats", "count", 3, "backend", "127.0.0.1:2003")
+	l.log(LevelWarning, "parser", "ignored")
+	l.log(LevelDebug, "flush", "ignored")
+	l.log(LevelError, "parser", "invalid value", "line", []byte("gorets:a b|c"), "detail", "")
+	assert.Equal(t, "2026/10/18 12:00:00 INFO: flush: sent stats count=3 backend=127.0.0.1:2003\n"+
+		"2026/10/18 12:00:00 ERROR: parser: invalid value line=\"gorets:a b|c\" detail=\"\"\n", out.String())
+
+	var nilLogger *logger
+	nilLogger.log(LevelError, "parser", "discarded")
+	nilLogger.reportSuppressed(true)
+}
+
+func TestLoggerJSON(t *testing.T) {
+	opts := DefaultOptions()
+	opts.LogFormat = "json"
+	l, out, _ := newTestLogger(opts)
+
+	l.log(LevelError, "flush", "flush failed", "interval", int64(10), "error", assert.AnError)
+	var m map[string]interface{}
+	assert.Equal(t, nil, json.Unmarshal(out.Bytes(), &m))
+	assert.Equal(t, map[string]interface{}{
+		"time":      "2026-10-18T12:00:00Z",
+		"level":     "error",
+		"subsystem": "flush",
+		"msg":       "flush failed",
+		"interval":  float64(10),
+		"error":     assert.AnError.Error(),
+	}, m)
+}
+
+func TestLoggerRateLimit(t *testing.T) {
+	opts := DefaultOptions()
+	opts.LogRateLimit = 2
+	l, out, now := newTestLogger(opts)
+
+	for i := 0; i < 5; i++ {
+		l.log(LevelError, "parser", "invalid value", "n", i)
+		l.log(LevelInfo, "flush", "sent stats")
+	}
+	l.log(LevelError, "parser", "empty value")
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Equal(t, 8, len(lines))
+	assert.True(t, strings.HasSuffix(lines[2], "invalid value n=1"), lines[2])
+	assert.True(t, strings.HasSuffix(lines[7], "empty value"), lines[7])
+
+	out.Reset()
+	l.reportSuppressed(false)
+	assert.Equal(t, "", out.String())
+
+	*now = now.Add(time.Minute)
+	l.log(LevelError, "parser", "invalid value", "n", 5)
+	assert.Equal(t, "2026/10/18 12:01:00 ERROR: parser: suppressed repeated messages msg=\"invalid value\" count=3 since=2026-10-18T12:00:00Z\n"+
+		"2026/10/18 12:01:00 ERROR: parser: invalid value n=5\n", out.String())
+
+	out.Reset()
+	l.log(LevelError, "parser", "invalid value", "n", 6)
+	l.log(LevelError, "parser", "invalid value", "n", 7)
+	l.reportSuppressed(true)
+	assert.True(t, strings.HasSuffix(out.String(), "suppressed repeated messages msg=\"invalid value\" count=1 since=2026-10-18T12:01:00Z\n"), out.String())
+}
+
+func TestParserLogsBadLines(t *testing.T) {
+	l, out, _ := newTestLogger(DefaultOptions())
+	parser := NewParser(strings.NewReader("gorets:1,5|c\n\nglork:1|x\nnocolon\nok:1|c"), true, 1472)
+	parser.log = l
+	parser.source = func() string { return "10.0.0.7" }
+
+	var buckets []string
+	for {
+		p, more := parser.Next()
+		if p != nil {
+			buckets = append(buckets, p.Bucket)
+		}
+		if !more {
+			break
+		}
+	}
+	assert.Equal(t, []string{"ok"}, buckets)
+	assert.Equal(t, "2026/10/18 12:00:00 ERROR: parser: invalid value source=10.0.0.7 line=gorets:1,5|c detail=\"strconv.ParseFloat: parsing \\\"1,5\\\": invalid syntax\"\n"+
+		"2026/10/18 12:00:00 ERROR: parser: unknown type code source=10.0.0.7 line=glork:1|x detail=x\n"+
+		"2026/10/18 12:00:00 ERROR: parser: missing value source=10.0.0.7 line=nocolon\n", out.String())
+}
+
+func TestHeartbeatError(t *testing.T) {
+	assert.NotEqual(t, nil, heartbeat("/nonexistent/statsdaemon.heartbeat"))
+}
@@ -0,0 +1,267 @@
+package statsd
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Options configures a Server. Start from DefaultOptions, which matches the
+// statsdaemon command line defaults.
+type Options struct {
+	// FlushInterval (seconds) and Backend are those of the primary window. A
+	// nil Backend aggregates without sending anything.
+	FlushInterval int64
+	Backend       Backend
+	// Windows are additional flush intervals with their own aggregation.
+	Windows WindowSpecs
+	// AlignFlush flushes on wall-clock multiples of each window's interval,
+	// timestamped with the interval boundary.
+	AlignFlush bool
+	// ShutdownTimeout (seconds) bounds the final flush made by Server.Stop.
+	ShutdownTimeout int64
+
+	// StateFile, if set, is where the aggregates are saved on Stop, and
+	// gauges and inactivity every StateInterval seconds (0 for only on
+	// Stop), to be restored by NewServer if no more than StateMaxAge seconds
+	// old.
+	StateFile     string
+	StateInterval int64
+	StateMaxAge   int64
+
+	Listeners        []Listener
+	MaxUdpPacketSize int
+	EventSinks       EventSinks
+	// ForwardAddress is an upstream DogStatsD aggregator (UDP) the primary
+	// window forwards distributions to. Without it they are histograms.
+	ForwardAddress string
+
+	// Debug logs what is sent to the backends, unless LogLevels sets the
+	// flush subsystem's level, and throws away the aggregates of flushes
+	// that fail to dial rather than keeping them for the next one.
+	Debug         bool
+	HeartbeatFile string
+	// LogLevels, LogFormat (text or json) and LogOutput (stderr if nil)
+	// configure the server's logging. LogRateLimit is how many warnings and
+	// errors with the same message may be logged a minute, 0 for no limit.
+	LogLevels    LogLevels
+	LogFormat    string
+	LogOutput    io.Writer
+	LogRateLimit int
+	// AdminAddress is where Start serves the AdminHandler, if set.
+	AdminAddress string
+	// RecordFile, if set, is where Start records every line received, for
+	// Replay.
+	RecordFile string
+
+	Prefix       string
+	Postfix      string
+	RewriteRules RewriteRules
+	FilterRules  FilterRules
+
+	// ClientTimestamps is one of ignore, aggregate or forward. Aggregating
+	// late points into the intervals they belong to needs AlignFlush, so
+	// that those intervals' flush timestamps are known.
+	ClientTimestamps string
+	MaxLateness      int64
+
+	DeleteGauges     bool
+	PersistCountKeys int64
+	PersistGaugeKeys int64
+	PersistTimerKeys int64
+	PersistSetKeys   int64
+
+	CounterRates    bool
+	RateSuffix      string
+	EtsyNamespace   bool
+	GlobalPrefix    string
+	PrefixCounter   string
+	PrefixTimer     string
+	PrefixGauge     string
+	PrefixSet       string
+	PrefixHistogram string
+
+	Percentiles             Percentiles
+	TimerStats              TimerStats
+	TimerCompression        float64
+	DistributionCompression float64
+	SetHLLThreshold         int
+	SetHLLPrecision         uint
+
+	SourceRateLimit   float64
+	SourceRateBurst   int
+	CardinalityLimits CardinalityLimits
+	// CardinalityOverflow is fold or drop.
+	CardinalityOverflow string
+
+	// names of self-metrics, each disabled when empty
+	ReceiveCounter     string
+	FilterCounter      string
+	CardinalityCounter string
+	RateLimitCounter   string
+}
+
+func DefaultOptions() Options {
+	return Options{
+		FlushInterval:           10,
+		ShutdownTimeout:         10,
+		StateInterval:           60,
+		StateMaxAge:             600,
+		MaxUdpPacketSize:        1472,
+		ClientTimestamps:        "ignore",
+		MaxLateness:             60,
+		DeleteGauges:            true,
+		PersistCountKeys:        60,
+		RateSuffix:              "_ps",
+		GlobalPrefix:            "stats",
+		PrefixCounter:           "counters",
+		PrefixTimer:             "timers",
+		PrefixGauge:             "gauges",
+		PrefixSet:               "sets",
+		PrefixHistogram:         "histograms",
+		TimerStats:              TimerStats{"upper_N": true, "lower_N": true, "mean": true, "upper": true, "lower": true, "count": true},
+		DistributionCompression: 100,
+		SetHLLPrecision:         14,
+		CardinalityOverflow:     "fold",
+		LogLevels:               LogLevels{Default: LevelInfo},
+		LogFormat:               "text",
+		LogRateLimit:            10,
+	}
+}
+
+// validate checks o and sanitizes the prefixes in place.
+func (o *Options) validate() error {
+	if o.FlushInterval < 1 {
+		return fmt.Errorf("flush interval must be positive")
+	}
+	if o.ShutdownTimeout < 1 {
+		return fmt.Errorf("shutdown timeout must be positive")
+	}
+	if o.StateInterval < 0 {
+		return fmt.Errorf("state interval must not be negative")
+	}
+	if o.SetHLLPrecision < minHLLPrecision || o.SetHLLPrecision > maxHLLPrecision {
+		return fmt.Errorf("set HyperLogLog precision must be between %d and %d", minHLLPrecision, maxHLLPrecision)
+	}
+	if o.ClientTimestamps != "ignore" && o.ClientTimestamps != "aggregate" && o.ClientTimestamps != "forward" {
+		return fmt.Errorf("client timestamps must be ignore, aggregate or forward")
+	}
+	if o.ClientTimestamps == "aggregate" && !o.AlignFlush {
+		return fmt.Errorf("aggregating client timestamps needs aligned flushes")
+	}
+	if o.CardinalityOverflow != "fold" && o.CardinalityOverflow != "drop" {
+		return fmt.Errorf("cardinality overflow must be fold or drop")
+	}
+	if o.LogFormat != "text" && o.LogFormat != "json" {
+		return fmt.Errorf("log format must be text or json")
+	}
+	if o.LogRateLimit < 0 {
+		return fmt.Errorf("log rate limit must not be negative")
+	}
+	for _, p := range []*string{&o.Prefix, &o.Postfix, &o.GlobalPrefix, &o.PrefixCounter, &o.PrefixTimer,
+		&o.PrefixGauge, &o.PrefixSet, &o.PrefixHistogram} {
+		*p = sanitizeBucket([]byte(*p))
+	}
+	return nil
+}
+
+type Percentiles []*Percentile
+type Percentile struct {
+	float float64
+	str   string
+}
+
+func (a *Percentiles) Set(s string) error {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return err
+	}
+	*a = append(*a, &Percentile{f, strings.Replace(s, ".", "_", -1)})
+	return nil
+}
+func (p *Percentile) String() string {
+	return p.str
+}
+func (a *Percentiles) String() string {
+	return fmt.Sprintf("%v", *a)
+}
+
+// TimerStatNames lists every stat processTimers knows how to emit, in output
+// order. The _N variants are emitted once per percentile.
+var TimerStatNames = []string{
+	"upper_N", "lower_N", "mean_N", "sum_N", "sum_squares_N",
+	"mean", "upper", "lower", "count", "count_ps", "median", "std", "sum", "sum_squares",
+}
+
+type TimerStats map[string]bool
+
+// Set replaces the stats with the comma separated names in s, leaving them
+// as they were if any name is unknown.
+func (ts TimerStats) Set(s string) error {
+	parsed := make(map[string]bool)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		valid := false
+		for _, n := range TimerStatNames {
+			if n == name {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return fmt.Errorf("unknown timer stat %q", name)
+		}
+		parsed[name] = true
+	}
+	for name := range ts {
+		delete(ts, name)
+	}
+	for name := range parsed {
+		ts[name] = true
+	}
+	return nil
+}
+func (ts TimerStats) String() string {
+	var names []string
+	for _, name := range TimerStatNames {
+		if ts[name] {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+type WindowSpecs []*WindowSpec
+type WindowSpec struct {
+	Interval int64 // seconds
+	Backend  Backend
+}
+
+// Set parses "INTERVAL=GRAPHITE", where GRAPHITE may be - for no backend.
+func (ws *WindowSpecs) Set(s string) error {
+	split := strings.SplitN(s, "=", 2)
+	if len(split) != 2 || split[1] == "" {
+		return fmt.Errorf("invalid window %q (want INTERVAL=GRAPHITE)", s)
+	}
+	interval, err := strconv.ParseInt(split[0], 10, 64)
+	if err != nil || interval < 1 {
+		return fmt.Errorf("invalid window interval %q", split[0])
+	}
+	*ws = append(*ws, &WindowSpec{interval, NewGraphiteBackend(split[1])})
+	return nil
+}
+func (ws *WindowSpecs) String() string {
+	var specs []string
+	for _, spec := range *ws {
+		backend := "-"
+		if spec.Backend != nil {
+			backend = spec.Backend.String()
+		}
+		specs = append(specs, fmt.Sprintf("%d=%s", spec.Interval, backend))
+	}
+	return fmt.Sprintf("%v", specs)
+}
@@ -0,0 +1,324 @@
+package statsd
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strconv"
+)
+
+const (
+	MAX_UNPROCESSED_PACKETS = 1000
+	TCP_READ_SIZE           = 4096
+)
+
+type Packet struct {
+	Bucket    string
+	ValFlt    float64
+	ValStr    string
+	Modifier  string
+	Sampling  float32
+	Timestamp int64    // unix seconds from a DogStatsD |T field, or 0
+	Tags      []string // from a DogStatsD |# field, not used for aggregation
+
+	// set instead of the above for DogStatsD events and service checks
+	Event        *Event
+	ServiceCheck *ServiceCheck
+}
+
+// sanitizeBucket drops the characters graphite can't take in a bucket,
+// replacing spaces with '_' and slashes with '-'. It doesn't modify bucket,
+// which may be the line being parsed.
+func sanitizeBucket(bucket []byte) string {
+	clean := make([]byte, 0, len(bucket))
+	for _, c := range bucket {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9',
+			c == '-' || c == '.' || c == '_':
+			clean = append(clean, c)
+		case c == ' ':
+			clean = append(clean, '_')
+		case c == '/':
+			clean = append(clean, '-')
+		}
+	}
+	return string(clean)
+}
+
+type MsgParser struct {
+	reader       io.Reader
+	newbuf       []byte
+	buffer       []byte
+	partialReads bool
+	done         bool
+	pending      []*Packet // the rest of a multi-value line
+	record       func(line []byte)
+	// log is where bad lines are logged, with source's address
+	log    *logger
+	source func() string
+}
+
+func NewParser(reader io.Reader, partialReads bool, maxUdpPacketSize int) *MsgParser {
+	bufsz := maxUdpPacketSize
+	if partialReads {
+		bufsz = TCP_READ_SIZE
+	}
+	newbuf := make([]byte, bufsz)
+	return &MsgParser{reader: reader, newbuf: newbuf, buffer: newbuf[:0], partialReads: partialReads}
+}
+
+func (mp *MsgParser) Next() (*Packet, bool) {
+	if len(mp.pending) > 0 {
+		p := mp.pending[0]
+		mp.pending = mp.pending[1:]
+		return p, len(mp.pending) > 0 || !mp.done
+	}
+
+	buf := mp.buffer
+
+	for {
+		line, rest := mp.lineFrom(buf)
+
+		if line != nil {
+			mp.buffer = rest
+			return mp.first(line), true
+		}
+
+		if mp.done {
+			if len(rest) > 0 {
+				p := mp.first(rest)
+				return p, len(mp.pending) > 0
+			}
+			return nil, false
+		}
+
+		// for udp, each message independent
+		// for tcp, copy to front and append
+		// unless no '\n' in entire TCP_READ_SIZE
+		idx := 0
+		if mp.partialReads && len(buf) < TCP_READ_SIZE {
+			idx = len(buf)
+			copy(mp.newbuf, buf)
+		}
+		buf = mp.newbuf
+
+		n, err := mp.reader.Read(buf[idx:])
+		buf = buf[:idx+n]
+		if err != nil {
+			// a listener being closed times out reads once it is drained
+			if err != io.EOF && !os.IsTimeout(err) {
+				mp.log.log(LevelError, "listener", "read failed", "error", err)
+			}
+			mp.done = true
+		}
+	}
+}
+
+// first parses line and returns its first packet, keeping the rest for the
+// following calls to Next.
+func (mp *MsgParser) first(line []byte) *Packet {
+	if mp.record != nil {
+		mp.record(line)
+	}
+	packets, err := parseLine(line)
+	if err != nil && len(line) > 0 && mp.log.enabled(LevelError, "parser") {
+		perr := err.(*parseError)
+		source := ""
+		if mp.source != nil {
+			source = mp.source()
+		}
+		kv := []interface{}{"source", source, "line", line}
+		if perr.detail != "" {
+			kv = append(kv, "detail", perr.detail)
+		}
+		mp.log.log(LevelError, "parser", perr.reason, kv...)
+	}
+	if len(packets) == 0 {
+		return nil
+	}
+	mp.pending = packets[1:]
+	return packets[0]
+}
+
+func (mp *MsgParser) lineFrom(input []byte) ([]byte, []byte) {
+	split := bytes.SplitN(input, []byte("\n"), 2)
+	if len(split) == 2 {
+		return split[0], split[1]
+	}
+
+	if !mp.partialReads {
+		if len(input) == 0 {
+			input = nil
+		}
+		return input, []byte{}
+	}
+
+	// if input ended in '\n' then len(split) == 2 and returned above
+	return nil, input
+}
+
+// ParseLine returns the packets in one line of input. Besides the usual
+// bucket:value|type[|@rate][|#tags][|Ttimestamp], Etsy statsd style lines may
+// carry several values for one bucket, e.g. bucket:1|c:2|c|@0.1:300|ms, where
+// a ':' after the type code, sample rate or timestamp starts the next value.
+// Bad values are skipped without dropping the rest of the line.
+// Buckets are only sanitized; prefixes and rewrite rules are up to the Server.
+func ParseLine(line []byte) []*Packet {
+	packets, _ := parseLine(line)
+	return packets
+}
+
+// parseError is why a line, or part of it, was dropped. Its reason is the
+// same for every instance of a problem, so that a broken client repeating it
+// can be rate limited as one message.
+type parseError struct {
+	reason string
+	detail string
+}
+
+func (e *parseError) Error() string {
+	if e.detail == "" {
+		return e.reason
+	}
+	return e.reason + " - " + e.detail
+}
+
+// parseLine is ParseLine, also returning the first bad value's error.
+func parseLine(line []byte) ([]*Packet, error) {
+	if isEventLine(line) {
+		p, err := parseEventLine(line)
+		if err != nil {
+			return nil, err
+		}
+		return []*Packet{p}, nil
+	}
+
+	split := bytes.SplitN(line, []byte{':'}, 2)
+	if len(split) < 2 {
+		return nil, &parseError{reason: "missing value"}
+	}
+	bucket := sanitizeBucket(split[0])
+
+	var (
+		packets []*Packet
+		first   error
+	)
+	fields := bytes.Split(split[1], []byte{'|'})
+	for len(fields) > 0 {
+		group := [][]byte{fields[0]}
+		fields = fields[1:]
+		for len(fields) > 0 {
+			field := fields[0]
+			if i := bytes.IndexByte(field, ':'); i >= 0 && (len(group) == 1 || field[0] == '@' || field[0] == 'T') {
+				group = append(group, field[:i])
+				fields[0] = field[i+1:]
+				break
+			}
+			group = append(group, field)
+			fields = fields[1:]
+		}
+		var (
+			p   *Packet
+			err error
+		)
+		if len(group) < 2 {
+			if len(group[0]) > 0 {
+				err = &parseError{reason: "missing type code"}
+			}
+		} else {
+			p, err = parsePacket(bucket, group[0], string(group[1]), group[2:])
+		}
+		if p != nil {
+			packets = append(packets, p)
+		}
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return packets, first
+}
+
+func parsePacket(bucket string, val []byte, typeCode string, trailing [][]byte) (*Packet, error) {
+	// optional trailing fields: @sample_rate, #tags, Ttimestamp, c:container
+	sampling := float32(1)
+	var timestamp int64
+	var tags []string
+	for _, field := range trailing {
+		if len(field) == 0 {
+			continue
+		}
+		switch field[0] {
+		case '@':
+			if typeCode != "c" && typeCode != "ms" && typeCode != "h" && typeCode != "d" {
+				continue
+			}
+			f64, err := strconv.ParseFloat(string(field[1:]), 32)
+			if err != nil {
+				return nil, &parseError{"invalid sample rate", err.Error()}
+			}
+			sampling = float32(f64)
+		case 'T':
+			ts, err := strconv.ParseInt(string(field[1:]), 10, 64)
+			if err != nil {
+				return nil, &parseError{"invalid timestamp", err.Error()}
+			}
+			timestamp = ts
+		case '#':
+			tags = parseTags(field[1:])
+		}
+	}
+
+	if len(val) == 0 {
+		return nil, &parseError{reason: "empty value"}
+	}
+
+	var (
+		err      error
+		floatval float64
+		strval   string
+	)
+
+	switch typeCode {
+	case "c", "ms", "h", "d":
+		floatval, err = strconv.ParseFloat(string(val), 64)
+	case "g":
+		s := val
+		if val[0] == '+' || val[0] == '-' {
+			strval = string(val[0])
+			s = val[1:]
+		}
+		floatval, err = strconv.ParseFloat(string(s), 64)
+	case "s":
+		strval = string(val)
+	default:
+		return nil, &parseError{"unknown type code", typeCode}
+	}
+	if err != nil {
+		return nil, &parseError{"invalid value", err.Error()}
+	}
+
+	return &Packet{
+		Bucket:    bucket,
+		ValFlt:    floatval,
+		ValStr:    strval,
+		Modifier:  typeCode,
+		Sampling:  sampling,
+		Timestamp: timestamp,
+		Tags:      tags,
+	}, nil
+}
+
+func parseEventLine(line []byte) (*Packet, error) {
+	if bytes.HasPrefix(line, []byte("_sc|")) {
+		sc, err := parseServiceCheck(line)
+		if err != nil {
+			return nil, &parseError{"invalid service check", err.Error()}
+		}
+		return &Packet{Modifier: "_sc", ServiceCheck: sc}, nil
+	}
+	e, err := parseEvent(line)
+	if err != nil {
+		return nil, &parseError{"invalid event", err.Error()}
+	}
+	return &Packet{Modifier: "_e", Event: e}, nil
+}
@@ -0,0 +1,168 @@
+package statsd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// pcapReader yields the payloads of the UDP datagrams in a classic libpcap
+// capture (not pcapng), as captured by e.g. tcpdump -w. Only unfragmented
+// IPv4 and IPv6 without extension headers are understood; anything else is
+// skipped.
+type pcapReader struct {
+	r        io.Reader
+	order    binary.ByteOrder
+	nanos    bool
+	linkType uint32
+	port     int
+	header   [16]byte
+}
+
+const (
+	linkNull     = 0
+	linkEthernet = 1
+	linkRaw      = 101
+	linkLinuxSLL = 113
+)
+
+func isPcap(magic []byte) bool {
+	if len(magic) < 4 {
+		return false
+	}
+	m := binary.LittleEndian.Uint32(magic)
+	return m == 0xa1b2c3d4 || m == 0xd4c3b2a1 || m == 0xa1b23c4d || m == 0x4d3cb2a1
+}
+
+func newPcapReader(r io.Reader, port int) (*pcapReader, error) {
+	var header [24]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("reading pcap header - %s", err)
+	}
+	pr := &pcapReader{r: r, port: port}
+	switch binary.LittleEndian.Uint32(header[:]) {
+	case 0xa1b2c3d4:
+		pr.order = binary.LittleEndian
+	case 0xd4c3b2a1:
+		pr.order = binary.BigEndian
+	case 0xa1b23c4d:
+		pr.order, pr.nanos = binary.LittleEndian, true
+	case 0x4d3cb2a1:
+		pr.order, pr.nanos = binary.BigEndian, true
+	}
+	pr.linkType = pr.order.Uint32(header[20:])
+	switch pr.linkType {
+	case linkNull, linkEthernet, linkRaw, linkLinuxSLL:
+	default:
+		return nil, fmt.Errorf("unsupported pcap link type %d", pr.linkType)
+	}
+	return pr, nil
+}
+
+func (pr *pcapReader) Next() (*Record, error) {
+	for {
+		if _, err := io.ReadFull(pr.r, pr.header[:]); err != nil {
+			return nil, err
+		}
+		sec := int64(pr.order.Uint32(pr.header[0:]))
+		frac := int64(pr.order.Uint32(pr.header[4:]))
+		if !pr.nanos {
+			frac *= 1000
+		}
+		n := pr.order.Uint32(pr.header[8:])
+		if n > 1<<18 {
+			return nil, errors.New("invalid pcap record length")
+		}
+		frame := make([]byte, n)
+		if _, err := io.ReadFull(pr.r, frame); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+
+		source, payload := pr.udp(frame)
+		if payload != nil {
+			return &Record{Time: time.Unix(sec, frac), Source: source, Line: payload}, nil
+		}
+	}
+}
+
+// udp returns the source address and payload of frame, or a nil payload if
+// it isn't a whole UDP datagram to the port.
+func (pr *pcapReader) udp(frame []byte) (string, []byte) {
+	var ethertype uint16
+	switch pr.linkType {
+	case linkNull:
+		// the address family, in the byte order of the capturing host
+		if len(frame) < 4 {
+			return "", nil
+		}
+		family := binary.LittleEndian.Uint32(frame)
+		if family > 0xffff {
+			family = binary.BigEndian.Uint32(frame)
+		}
+		ethertype = 0x86dd
+		if family == 2 {
+			ethertype = 0x0800
+		}
+		frame = frame[4:]
+	case linkEthernet:
+		if len(frame) < 14 {
+			return "", nil
+		}
+		ethertype = binary.BigEndian.Uint16(frame[12:])
+		frame = frame[14:]
+		for ethertype == 0x8100 && len(frame) >= 4 {
+			ethertype = binary.BigEndian.Uint16(frame[2:])
+			frame = frame[4:]
+		}
+	case linkLinuxSLL:
+		if len(frame) < 16 {
+			return "", nil
+		}
+		ethertype = binary.BigEndian.Uint16(frame[14:])
+		frame = frame[16:]
+	case linkRaw:
+		if len(frame) < 1 {
+			return "", nil
+		}
+		ethertype = 0x0800
+		if frame[0]>>4 == 6 {
+			ethertype = 0x86dd
+		}
+	}
+
+	var source net.IP
+	switch ethertype {
+	case 0x0800:
+		if len(frame) < 20 || frame[0]>>4 != 4 {
+			return "", nil
+		}
+		ihl := int(frame[0]&0x0f) * 4
+		fragment := binary.BigEndian.Uint16(frame[6:]) & 0x3fff
+		if frame[9] != 17 || fragment != 0 || ihl < 20 || len(frame) < ihl {
+			return "", nil
+		}
+		source = net.IP(frame[12:16])
+		frame = frame[ihl:]
+	case 0x86dd:
+		if len(frame) < 40 || frame[6] != 17 {
+			return "", nil
+		}
+		source = net.IP(frame[8:24])
+		frame = frame[40:]
+	default:
+		return "", nil
+	}
+
+	if len(frame) < 8 {
+		return "", nil
+	}
+	port := int(binary.BigEndian.Uint16(frame[2:]))
+	length := int(binary.BigEndian.Uint16(frame[4:]))
+	if (pr.port != 0 && port != pr.port) || length < 8 || length > len(frame) {
+		return "", nil
+	}
+	return source.String(), frame[8:length]
+}
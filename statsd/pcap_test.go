@@ -0,0 +1,90 @@
+package statsd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testPcap writes a little endian, microsecond pcap of frames.
+func testPcap(linkType uint32, frames ...[]byte) *bytes.Buffer {
+	var b bytes.Buffer
+	for _, v := range []uint32{0xa1b2c3d4, 0x00040002, 0, 0, 65535, linkType} {
+		binary.Write(&b, binary.LittleEndian, v)
+	}
+	for i, frame := range frames {
+		for _, v := range []uint32{1000 + uint32(i), 500, uint32(len(frame)), uint32(len(frame))} {
+			binary.Write(&b, binary.LittleEndian, v)
+		}
+		b.Write(frame)
+	}
+	return &b
+}
+
+func udpDatagram(port uint16, payload string) []byte {
+	udp := make([]byte, 8)
+	binary.BigEndian.PutUint16(udp[0:], 40000)
+	binary.BigEndian.PutUint16(udp[2:], port)
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(payload)))
+	return append(udp, payload...)
+}
+
+func ipv4Frame(port uint16, payload string) []byte {
+	ip := make([]byte, 20)
+	ip[0] = 0x45
+	ip[9] = 17
+	copy(ip[12:], []byte{10, 0, 0, 1})
+	copy(ip[16:], []byte{10, 0, 0, 2})
+	ethernet := make([]byte, 14)
+	binary.BigEndian.PutUint16(ethernet[12:], 0x0800)
+	return append(append(ethernet, ip...), udpDatagram(port, payload)...)
+}
+
+func TestPcapReader(t *testing.T) {
+	fragment := ipv4Frame(8125, "glork:1|c")
+	fragment[14+6] = 0x20 // more fragments
+
+	capture := testPcap(linkEthernet,
+		ipv4Frame(8125, "gorets:1|c\ngaugor:2|g"),
+		ipv4Frame(53, "not statsd"),
+		fragment,
+		ipv4Frame(8125, "glork:320|ms"),
+	)
+	records, err := OpenRecords(capture, 8125)
+	assert.Equal(t, nil, err)
+
+	rec, err := records.Next()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, time.Unix(1000, 500000), rec.Time)
+	assert.Equal(t, "10.0.0.1", rec.Source)
+	assert.Equal(t, "gorets:1|c\ngaugor:2|g", string(rec.Line))
+
+	rec, err = records.Next()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, time.Unix(1003, 500000), rec.Time)
+	assert.Equal(t, "glork:320|ms", string(rec.Line))
+
+	_, err = records.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestPcapReaderRawIPv6(t *testing.T) {
+	ip := make([]byte, 40)
+	ip[0] = 0x60
+	ip[6] = 17
+	ip[23] = 1 // ::1
+
+	records, err := OpenRecords(testPcap(linkRaw, append(ip, udpDatagram(8125, "gorets:1|c")...)), 0)
+	assert.Equal(t, nil, err)
+	rec, err := records.Next()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "::1", rec.Source)
+	assert.Equal(t, "gorets:1|c", string(rec.Line))
+
+	_, err = OpenRecords(testPcap(12345), 0)
+	assert.NotEqual(t, nil, err)
+}
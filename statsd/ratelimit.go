@@ -0,0 +1,111 @@
+package statsd
+
+import (
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// sourceLimiter keeps a token bucket per source address, shared by all
+// listener goroutines.
+type sourceLimiter struct {
+	sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+	dropped map[string]int64
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newSourceLimiter(rate float64, burst int) *sourceLimiter {
+	// one second's worth, but at least a line, or nothing would get through
+	b := float64(burst)
+	if b < 1 {
+		b = math.Max(rate, 1)
+	}
+	return &sourceLimiter{
+		rate:    rate,
+		burst:   b,
+		buckets: make(map[string]*tokenBucket),
+		dropped: make(map[string]int64),
+	}
+}
+
+// allow takes a token from source's bucket, returning false (and counting
+// the drop) if it is empty.
+func (sl *sourceLimiter) allow(source string, now time.Time) bool {
+	sl.Lock()
+	defer sl.Unlock()
+
+	b, ok := sl.buckets[source]
+	if !ok {
+		b = &tokenBucket{tokens: sl.burst, last: now}
+		sl.buckets[source] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * sl.rate
+	if b.tokens > sl.burst {
+		b.tokens = sl.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		sl.dropped[source]++
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// drainDropped returns and resets the per-source drop counts. Buckets idle
+// long enough to have refilled are forgotten along the way.
+func (sl *sourceLimiter) drainDropped(now time.Time) map[string]int64 {
+	sl.Lock()
+	defer sl.Unlock()
+
+	refill := time.Duration(sl.burst / sl.rate * float64(time.Second))
+	for source, b := range sl.buckets {
+		if now.Sub(b.last) > refill {
+			delete(sl.buckets, source)
+		}
+	}
+	dropped := sl.dropped
+	sl.dropped = make(map[string]int64)
+	return dropped
+}
+
+// udpSourceReader reads datagrams from a UDP socket, remembering who sent
+// the last one.
+type udpSourceReader struct {
+	conn *net.UDPConn
+	addr *net.UDPAddr
+}
+
+func (r *udpSourceReader) Read(p []byte) (int, error) {
+	n, addr, err := r.conn.ReadFromUDP(p)
+	r.addr = addr
+	return n, err
+}
+
+func (r *udpSourceReader) source() string {
+	if r.addr == nil {
+		return ""
+	}
+	return r.addr.IP.String()
+}
+
+// remoteHost is the address of a stream peer without its port.
+func remoteHost(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,54 @@
+package statsd
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSourceLimiter(t *testing.T) {
+	sl := newSourceLimiter(10, 2)
+	now := time.Unix(1418052649, 0)
+
+	assert.True(t, sl.allow("10.0.0.1", now))
+	assert.True(t, sl.allow("10.0.0.1", now))
+	assert.False(t, sl.allow("10.0.0.1", now))
+	assert.True(t, sl.allow("10.0.0.2", now))
+
+	// 100ms refills one token
+	now = now.Add(100 * time.Millisecond)
+	assert.True(t, sl.allow("10.0.0.1", now))
+	assert.False(t, sl.allow("10.0.0.1", now))
+
+	dropped := sl.drainDropped(now)
+	assert.Equal(t, map[string]int64{"10.0.0.1": 2}, dropped)
+	assert.Equal(t, 0, len(sl.drainDropped(now)))
+
+	// idle buckets are forgotten once they would have refilled
+	sl.drainDropped(now.Add(time.Second))
+	assert.Equal(t, 0, len(sl.buckets))
+}
+
+func TestSourceLimiterDefaultBurst(t *testing.T) {
+	sl := newSourceLimiter(5, 0)
+	assert.Equal(t, float64(5), sl.burst)
+}
+
+func TestSourceLimiterSlowRate(t *testing.T) {
+	sl := newSourceLimiter(0.5, 0)
+	now := time.Unix(1418052649, 0)
+
+	assert.True(t, sl.allow("10.0.0.1", now))
+	assert.False(t, sl.allow("10.0.0.1", now))
+	// a line every two seconds
+	assert.False(t, sl.allow("10.0.0.1", now.Add(time.Second)))
+	assert.True(t, sl.allow("10.0.0.1", now.Add(2*time.Second)))
+}
+
+func TestRemoteHost(t *testing.T) {
+	assert.Equal(t, "10.0.0.1", remoteHost(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}))
+	assert.Equal(t, "::1", remoteHost(&net.TCPAddr{IP: net.ParseIP("::1"), Port: 1234}))
+	assert.Equal(t, "", remoteHost(nil))
+}
@@ -0,0 +1,148 @@
+package statsd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// A recording starts with recordMagic, followed by one record per received
+// line:
+//
+//	varint   nanoseconds since the previous record (since the epoch for the first)
+//	uvarint  length of the source address, then the address
+//	uvarint  length of the line, then the line
+const recordMagic = "statsdaemon-record-1\n"
+
+// Record is one line as it was received.
+type Record struct {
+	Time   time.Time
+	Source string
+	Line   []byte
+}
+
+// Recorder appends the lines every listener receives to a file.
+type Recorder struct {
+	mu   sync.Mutex
+	file *os.File
+	w    *bufio.Writer
+	last int64
+	buf  [binary.MaxVarintLen64]byte
+	err  error
+}
+
+func NewRecorder(path string) (*Recorder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("creating recording - %s", err)
+	}
+	r := &Recorder{file: file, w: bufio.NewWriter(file)}
+	r.w.WriteString(recordMagic)
+	return r, nil
+}
+
+// Record appends line, received now from source. Write errors are kept for
+// Flush and Close to return.
+func (r *Recorder) Record(source string, line []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now().UnixNano()
+	r.w.Write(r.buf[:binary.PutVarint(r.buf[:], now-r.last)])
+	r.last = now
+	r.w.Write(r.buf[:binary.PutUvarint(r.buf[:], uint64(len(source)))])
+	r.w.WriteString(source)
+	r.w.Write(r.buf[:binary.PutUvarint(r.buf[:], uint64(len(line)))])
+	_, err := r.w.Write(line)
+	if err != nil && r.err == nil {
+		r.err = err
+	}
+}
+
+// Flush writes out the buffered records.
+func (r *Recorder) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.w.Flush(); err != nil && r.err == nil {
+		r.err = err
+	}
+	return r.err
+}
+
+func (r *Recorder) Close() error {
+	err := r.Flush()
+	if cerr := r.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// RecordSource yields received lines, or datagrams of them, in the order they
+// arrived. Next returns io.EOF at the end.
+type RecordSource interface {
+	Next() (*Record, error)
+}
+
+// OpenRecords reads a recording made with a Recorder or a pcap capture of
+// statsd UDP traffic to port (0 for any port).
+func OpenRecords(reader io.Reader, port int) (RecordSource, error) {
+	br := bufio.NewReader(reader)
+	magic, err := br.Peek(len(recordMagic))
+	if err == nil && string(magic) == recordMagic {
+		br.Discard(len(recordMagic))
+		return &recordReader{r: br}, nil
+	}
+	if isPcap(magic) {
+		return newPcapReader(br, port)
+	}
+	return nil, errors.New("not a statsdaemon recording or pcap file")
+}
+
+type recordReader struct {
+	r    *bufio.Reader
+	last int64
+}
+
+func (rr *recordReader) Next() (*Record, error) {
+	delta, err := binary.ReadVarint(rr.r)
+	if err != nil {
+		return nil, err
+	}
+	rr.last += delta
+	source, err := rr.bytes()
+	if err != nil {
+		return nil, err
+	}
+	line, err := rr.bytes()
+	if err != nil {
+		return nil, err
+	}
+	return &Record{Time: time.Unix(0, rr.last), Source: string(source), Line: line}, nil
+}
+
+func (rr *recordReader) bytes() ([]byte, error) {
+	n, err := binary.ReadUvarint(rr.r)
+	if err == nil && n > 1<<16 {
+		err = errors.New("invalid record length")
+	}
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rr.r, b); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return b, nil
+}
+
+// unexpectedEOF is for EOFs in the middle of a record.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,120 @@
+package statsd
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsdaemon")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "recording")
+
+	r, err := NewRecorder(path)
+	assert.Equal(t, nil, err)
+	before := time.Now()
+	r.Record("10.0.0.1", []byte("gorets:1|c"))
+	r.Record("", []byte("glork:320|ms"))
+	assert.Equal(t, nil, r.Close())
+
+	file, err := os.Open(path)
+	assert.Equal(t, nil, err)
+	defer file.Close()
+	records, err := OpenRecords(file, 0)
+	assert.Equal(t, nil, err)
+
+	rec, err := records.Next()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "10.0.0.1", rec.Source)
+	assert.Equal(t, "gorets:1|c", string(rec.Line))
+	assert.False(t, rec.Time.Before(before))
+	first := rec.Time
+	rec, err = records.Next()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", rec.Source)
+	assert.Equal(t, "glork:320|ms", string(rec.Line))
+	assert.False(t, rec.Time.Before(first))
+	_, err = records.Next()
+	assert.Equal(t, io.EOF, err)
+
+	_, err = OpenRecords(bytes.NewBufferString("gorets:1|c\n"), 0)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestServerRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsdaemon")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.RecordFile = filepath.Join(dir, "recording")
+	opts.Listeners = []Listener{&UDPListener{Address: "127.0.0.1:8130"}}
+	s := newTestServer(t, opts)
+	assert.Equal(t, nil, s.Start())
+
+	conn, err := net.Dial("udp", "127.0.0.1:8130")
+	assert.Equal(t, nil, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("gorets:1|c\nbad line"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, s.Stop())
+
+	file, err := os.Open(opts.RecordFile)
+	assert.Equal(t, nil, err)
+	defer file.Close()
+	records, err := OpenRecords(file, 0)
+	assert.Equal(t, nil, err)
+	for _, line := range []string{"gorets:1|c", "bad line"} {
+		rec, err := records.Next()
+		assert.Equal(t, nil, err)
+		assert.Equal(t, "127.0.0.1", rec.Source)
+		assert.Equal(t, line, string(rec.Line))
+	}
+}
+
+// testRecords replays fixed records.
+type testRecords []*Record
+
+func (tr *testRecords) Next() (*Record, error) {
+	if len(*tr) == 0 {
+		return nil, io.EOF
+	}
+	rec := (*tr)[0]
+	*tr = (*tr)[1:]
+	return rec, nil
+}
+
+func TestReplay(t *testing.T) {
+	records := &testRecords{
+		{Time: time.Unix(1001, 0), Line: []byte("gorets:1|c\ngaugor:5|g")},
+		{Time: time.Unix(1009, 0), Line: []byte("gorets:2|c")},
+		{Time: time.Unix(1010, 0), Line: []byte("gorets:4|c")},
+		{Time: time.Unix(1035, 0), Line: []byte("gorets:8|c")},
+	}
+	opts := DefaultOptions()
+	opts.PersistCountKeys = 0
+	opts.DeleteGauges = false
+	opts.Windows.Set("60=-")
+	var out bytes.Buffer
+	assert.Equal(t, nil, Replay(opts, records, &out))
+
+	// nothing arrived in the 10s interval up to 1030, the gauge is still sent
+	assert.ElementsMatch(t, []string{
+		"gorets 3 1010", "gaugor 5 1010",
+		"gorets 4 1020", "gaugor 5 1020",
+		"gaugor 5 1030",
+		"gorets 8 1040", "gaugor 5 1040",
+		"gorets 7 1020", "gaugor 5 1020",
+		"gorets 8 1080", "gaugor 5 1080",
+	}, strings.Split(strings.TrimSpace(out.String()), "\n"))
+}
@@ -0,0 +1,119 @@
+package statsd
+
+import (
+	"bytes"
+	"io"
+	"time"
+)
+
+// Replay aggregates recorded lines as a Server with opts would have, on the
+// recording's clock: each window is flushed at every multiple of its interval
+// the records pass, and once more after the last one. The output of every
+// window is written to out as graphite lines, whatever the backends in opts
+// say. Nothing is sent anywhere else, so distributions are aggregated like
+// histograms and events are dropped.
+func Replay(opts Options, records RecordSource, out io.Writer) error {
+	backend := &writerBackend{out}
+	opts.Backend = backend
+	windows := make(WindowSpecs, len(opts.Windows))
+	for i, spec := range opts.Windows {
+		windows[i] = &WindowSpec{Interval: spec.Interval, Backend: backend}
+	}
+	opts.Windows = windows
+	opts.Listeners = nil
+	opts.EventSinks = nil
+	opts.ForwardAddress = ""
+	opts.HeartbeatFile = ""
+	opts.StateFile = ""
+	// flushes are on interval boundaries anyway
+	opts.AlignFlush = true
+
+	s, err := NewServer(opts)
+	if err != nil {
+		return err
+	}
+
+	next := make([]time.Time, len(s.windows))
+	for {
+		rec, err := records.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if err := s.replayFlushes(next, rec.Time); err != nil {
+			return err
+		}
+
+		for _, line := range bytes.Split(rec.Line, []byte("\n")) {
+			for _, p := range ParseLine(line) {
+				if s.sourceLimits != nil && !s.sourceLimits.allow(rec.Source, rec.Time) {
+					continue
+				}
+				s.handlePacket(p)
+			}
+		}
+	}
+	// the intervals of the last records end at the next boundaries
+	for i := range s.windows {
+		if next[i].IsZero() {
+			break
+		}
+		if err := s.replayFlush(i, next[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replayFlushes submits each window for every boundary up to now, starting
+// from the first one after now on the first call.
+func (s *Server) replayFlushes(next []time.Time, now time.Time) error {
+	for i, w := range s.windows {
+		period := time.Duration(w.interval) * time.Second
+		if next[i].IsZero() {
+			next[i] = nextBoundary(now, period)
+		}
+		for !now.Before(next[i]) {
+			if err := s.replayFlush(i, next[i]); err != nil {
+				return err
+			}
+			next[i] = next[i].Add(period)
+		}
+	}
+	return nil
+}
+
+func (s *Server) replayFlush(i int, now time.Time) error {
+	if i == 0 {
+		s.countRateLimited(now)
+	}
+	if err := s.windows[i].submit(now.Unix(), time.Time{}); err != nil {
+		return err
+	}
+	if i == 0 {
+		s.opts.CardinalityLimits.reset()
+	}
+	return nil
+}
+
+// writerBackend is a Backend writing to an io.Writer, for Replay.
+type writerBackend struct {
+	w io.Writer
+}
+
+func (b *writerBackend) Dial(deadline time.Time) (io.WriteCloser, error) {
+	return b, nil
+}
+
+func (b *writerBackend) Write(p []byte) (int, error) {
+	return b.w.Write(p)
+}
+
+func (b *writerBackend) Close() error {
+	return nil
+}
+
+func (b *writerBackend) String() string {
+	return "replay output"
+}
@@ -0,0 +1,135 @@
+package statsd
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// RewriteRule renames buckets after sanitizing. Two forms are accepted:
+//
+//	regex PATTERN REPLACEMENT
+//	OUTPUT_TEMPLATE [(FREQUENCY)] = [METHOD] INPUT_PATTERN
+//
+// The first is a regular expression whose REPLACEMENT may refer to capture
+// groups as $1 or ${name}. The second is a carbon-aggregator style rule, e.g.
+//
+//	<service>.latency = servers.*.<service>.latency
+//
+// where <field> in INPUT_PATTERN matches one dot-separated node, <<field>>
+// matches one or more nodes and * matches within a node that is thrown away.
+// Aggregation follows the metric type, so FREQUENCY and METHOD are only
+// accepted for compatibility with existing carbon-aggregator rules.
+type RewriteRule struct {
+	rule        string
+	regexp      *regexp.Regexp
+	replacement string
+}
+
+type RewriteRules []*RewriteRule
+
+var rewriteField = regexp.MustCompile(`<<([A-Za-z0-9_]+)>>|<([A-Za-z0-9_]+)>`)
+
+func (rr *RewriteRules) Set(s string) error {
+	fields := strings.Fields(s)
+	var r *RewriteRule
+	var err error
+	if len(fields) > 0 && fields[0] == "regex" {
+		r, err = parseRegexRewrite(fields[1:])
+	} else {
+		r, err = parseAggregationRewrite(fields)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid rewrite rule %q - %s", s, err)
+	}
+	r.rule = s
+	*rr = append(*rr, r)
+	return nil
+}
+
+func (rr *RewriteRules) String() string {
+	var rules []string
+	for _, r := range *rr {
+		rules = append(rules, r.rule)
+	}
+	return fmt.Sprintf("%v", rules)
+}
+
+func parseRegexRewrite(fields []string) (*RewriteRule, error) {
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("want regex PATTERN REPLACEMENT")
+	}
+	re, err := regexp.Compile(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	return &RewriteRule{regexp: re, replacement: fields[1]}, nil
+}
+
+func parseAggregationRewrite(fields []string) (*RewriteRule, error) {
+	eq := -1
+	for i, f := range fields {
+		if f == "=" {
+			eq = i
+			break
+		}
+	}
+	// OUTPUT [(FREQUENCY)] = [METHOD] INPUT
+	if eq < 1 || eq > 2 || len(fields)-eq < 2 || len(fields)-eq > 3 {
+		return nil, fmt.Errorf("want OUTPUT [(FREQUENCY)] = [METHOD] INPUT")
+	}
+	output := fields[0]
+	input := fields[len(fields)-1]
+
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	for i, node := range strings.Split(input, ".") {
+		if i > 0 {
+			pattern.WriteString(`\.`)
+		}
+		if node == "*" {
+			pattern.WriteString(`[^.]+`)
+			continue
+		}
+		last := 0
+		for _, m := range rewriteField.FindAllStringSubmatchIndex(node, -1) {
+			pattern.WriteString(globToRegexp(node[last:m[0]]))
+			if m[2] >= 0 {
+				pattern.WriteString("(?P<" + node[m[2]:m[3]] + ">.+)")
+			} else {
+				pattern.WriteString("(?P<" + node[m[4]:m[5]] + ">[^.]+)")
+			}
+			last = m[1]
+		}
+		pattern.WriteString(globToRegexp(node[last:]))
+	}
+	pattern.WriteString("$")
+
+	re, err := regexp.Compile(pattern.String())
+	if err != nil {
+		return nil, err
+	}
+	replacement := rewriteField.ReplaceAllString(output, "$${$1$2}")
+	return &RewriteRule{regexp: re, replacement: replacement}, nil
+}
+
+func globToRegexp(s string) string {
+	return strings.Replace(regexp.QuoteMeta(s), `\*`, `[^.]*`, -1)
+}
+
+// rewrite returns bucket renamed by the first matching rule, sanitized again
+// since the replacement may introduce characters graphite can't handle.
+func (rr RewriteRules) rewrite(bucket string) string {
+	for _, r := range rr {
+		m := r.regexp.FindStringSubmatchIndex(bucket)
+		if m == nil {
+			continue
+		}
+		var dst []byte
+		dst = append(dst, bucket[:m[0]]...)
+		dst = r.regexp.ExpandString(dst, r.replacement, bucket, m)
+		dst = append(dst, bucket[m[1]:]...)
+		return sanitizeBucket(dst)
+	}
+	return bucket
+}
@@ -0,0 +1,36 @@
+package statsd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRewriteRulesRegex(t *testing.T) {
+	var rr RewriteRules
+	assert.Equal(t, nil, rr.Set(`regex ^servers\.([^.]+)\.(.+)$ $2.$1`))
+	assert.Equal(t, nil, rr.Set(`regex \.tmp$ .scratch`))
+
+	assert.Equal(t, "api.latency.host123", rr.rewrite("servers.host123.api.latency"))
+	assert.Equal(t, "foo.scratch", rr.rewrite("foo.tmp"))
+	assert.Equal(t, "unchanged", rr.rewrite("unchanged"))
+
+	assert.NotEqual(t, nil, rr.Set(`regex (foo $1`))
+	assert.NotEqual(t, nil, rr.Set(`regex foo`))
+}
+
+func TestRewriteRulesAggregation(t *testing.T) {
+	var rr RewriteRules
+	assert.Equal(t, nil, rr.Set("<svc>.<metric> = servers.*.<svc>.<metric>"))
+	assert.Equal(t, nil, rr.Set("<env>.all.<<rest>> (60) = sum <env>.host*.<<rest>>"))
+	assert.Equal(t, nil, rr.Set("cluster_<n>.total = cluster<n>.*"))
+
+	assert.Equal(t, "api.latency", rr.rewrite("servers.host123.api.latency"))
+	assert.Equal(t, "prod.all.api.latency.p99", rr.rewrite("prod.host12.api.latency.p99"))
+	assert.Equal(t, "cluster_7.total", rr.rewrite("cluster7.requests"))
+	assert.Equal(t, "servers.web1.api", rr.rewrite("servers.web1.api"))
+
+	assert.NotEqual(t, nil, rr.Set("foo.bar"))
+	assert.NotEqual(t, nil, rr.Set("= foo.bar"))
+	assert.NotEqual(t, nil, rr.Set("a b c = foo.bar"))
+}
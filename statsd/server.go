@@ -0,0 +1,475 @@
+package statsd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server receives metrics from its listeners, aggregates them in one window
+// per flush interval and sends the results to each window's backend. All
+// aggregation happens on a single goroutine started by Start.
+type Server struct {
+	opts    Options
+	in      chan *Packet
+	windows []*window
+
+	// sourceLimits is nil unless SourceRateLimit is set
+	sourceLimits *sourceLimiter
+	// eventQueue is nil unless there are EventSinks
+	eventQueue chan *Packet
+	// admin is nil unless AdminAddress is set
+	admin *http.Server
+	taps  *taps
+	log   *logger
+	// recorder is nil unless RecordFile is set
+	recorder *Recorder
+
+	flushReqs chan chan error
+	stop      chan struct{}
+	stopped   chan error
+	// started is set by a successful Start; stopOnce and stopErr make
+	// repeated Stops return the first one's result
+	started  bool
+	stopOnce sync.Once
+	stopErr  error
+}
+
+func NewServer(opts Options) (*Server, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	opts.CardinalityLimits = opts.CardinalityLimits.clone()
+
+	s := &Server{
+		opts:      opts,
+		in:        make(chan *Packet, MAX_UNPROCESSED_PACKETS),
+		flushReqs: make(chan chan error),
+		stop:      make(chan struct{}),
+		stopped:   make(chan error, 1),
+		taps:      &taps{},
+		log:       newLogger(&opts),
+	}
+	primary := newWindow(&s.opts, opts.FlushInterval, opts.Backend)
+	primary.forward = opts.ForwardAddress
+	s.windows = append(s.windows, primary)
+	for _, spec := range opts.Windows {
+		s.windows = append(s.windows, newWindow(&s.opts, spec.Interval, spec.Backend))
+	}
+	for _, w := range s.windows {
+		w.taps = s.taps
+		w.log = s.log
+	}
+	// each server logs events through its own logger
+	s.opts.EventSinks = make(EventSinks, len(opts.EventSinks))
+	for i, sink := range opts.EventSinks {
+		if _, ok := sink.(*logSink); ok {
+			sink = &logSink{log: s.log}
+		}
+		s.opts.EventSinks[i] = sink
+	}
+	if opts.SourceRateLimit > 0 {
+		s.sourceLimits = newSourceLimiter(opts.SourceRateLimit, opts.SourceRateBurst)
+	}
+	if opts.StateFile != "" {
+		if err := s.loadState(); err != nil {
+			s.log.log(LevelError, "state", "restoring state failed", "error", err)
+		}
+	}
+	return s, nil
+}
+
+// Start opens every listener and the admin API and starts aggregating in the
+// background.
+func (s *Server) Start() error {
+	if s.opts.RecordFile != "" {
+		recorder, err := NewRecorder(s.opts.RecordFile)
+		if err != nil {
+			return err
+		}
+		s.recorder = recorder
+	}
+	if s.opts.AdminAddress != "" {
+		listener, err := net.Listen("tcp", s.opts.AdminAddress)
+		if err != nil {
+			s.closeRecorder()
+			return fmt.Errorf("admin API - %s", err)
+		}
+		s.log.log(LevelInfo, "admin", "listening", "address", listener.Addr())
+		s.admin = &http.Server{Handler: s.AdminHandler()}
+		go s.admin.Serve(listener)
+	}
+	for i, l := range s.opts.Listeners {
+		if err := l.Listen(s); err != nil {
+			for _, started := range s.opts.Listeners[:i] {
+				started.Close()
+			}
+			if s.admin != nil {
+				s.admin.Close()
+			}
+			s.closeRecorder()
+			return err
+		}
+	}
+	if len(s.opts.EventSinks) > 0 {
+		s.eventQueue = make(chan *Packet, MAX_UNPROCESSED_PACKETS)
+		go sendEvents(s.eventQueue, s.opts.EventSinks, s.log)
+	}
+	go s.monitor()
+	s.started = true
+	return nil
+}
+
+// Stop closes the listeners, aggregates what they had already received and
+// flushes every window one last time within ShutdownTimeout, then saves the
+// StateFile. It returns the first error from doing so. Stopping a server
+// that wasn't started does nothing, and stopping it again returns the same.
+func (s *Server) Stop() error {
+	s.stopOnce.Do(func() {
+		if !s.started {
+			return
+		}
+		if s.admin != nil {
+			s.admin.Close()
+		}
+		for _, l := range s.opts.Listeners {
+			l.Close()
+		}
+		s.closeRecorder()
+		close(s.stop)
+		s.stopErr = <-s.stopped
+		if s.eventQueue != nil {
+			close(s.eventQueue)
+		}
+	})
+	return s.stopErr
+}
+
+func (s *Server) closeRecorder() {
+	if s.recorder == nil {
+		return
+	}
+	if err := s.recorder.Close(); err != nil {
+		s.log.log(LevelError, "record", "recording failed", "file", s.opts.RecordFile, "error", err)
+	}
+}
+
+// Flush sends the aggregates of every window to its backend now, as if its
+// interval had ended, including the packets already queued. It must be
+// called between Start and Stop, and without AlignFlush, as the interval's
+// own flush would overwrite what it sent under the same timestamp.
+func (s *Server) Flush() error {
+	if !s.started {
+		return errors.New("server not started")
+	}
+	if s.opts.AlignFlush {
+		return errors.New("can't flush early with aligned flushes")
+	}
+	errc := make(chan error)
+	select {
+	case s.flushReqs <- errc:
+		return <-errc
+	case <-s.stop:
+		return errors.New("server stopped")
+	}
+}
+
+// AdminHandler serves the admin API, which Start serves on AdminAddress:
+//
+//	GET /tap?pattern=GLOB&direction=in|out|both&duration=30s
+//
+// streams the matching incoming packets and/or outgoing lines.
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tap", s.serveTap)
+	return mux
+}
+
+type flushTick struct {
+	w    *window
+	tick time.Time
+}
+
+func (s *Server) monitor() {
+	flushes := make(chan flushTick)
+	for _, w := range s.windows {
+		go s.tickWindow(w, flushes)
+	}
+	var checkpoints <-chan time.Time
+	if s.opts.StateFile != "" && s.opts.StateInterval > 0 {
+		ticker := time.NewTicker(time.Duration(s.opts.StateInterval) * time.Second)
+		defer ticker.Stop()
+		checkpoints = ticker.C
+	}
+	for {
+		select {
+		case <-s.stop:
+			s.drain()
+			timeout := time.Duration(s.opts.ShutdownTimeout) * time.Second
+			err := s.flushAll(time.Now().Add(timeout))
+			if serr := s.saveState(true); serr != nil {
+				s.log.log(LevelError, "state", "saving state failed", "error", serr)
+				if err == nil {
+					err = serr
+				}
+			}
+			s.log.reportSuppressed(true)
+			s.stopped <- err
+			return
+		case <-checkpoints:
+			if err := s.saveState(false); err != nil {
+				s.log.log(LevelError, "state", "saving state failed", "error", err)
+			}
+		case errc := <-s.flushReqs:
+			s.drain()
+			errc <- s.flushAll(time.Time{})
+		case f := <-flushes:
+			period := time.Duration(f.w.interval) * time.Second
+			now := time.Now()
+			if s.opts.AlignFlush {
+				now = f.tick
+			}
+			s.countRateLimited(time.Now())
+			if err := f.w.submit(now.Unix(), time.Now().Add(period)); err != nil {
+				s.log.log(LevelError, "flush", "flush failed", "interval", f.w.interval, "error", err)
+			}
+			if f.w == s.windows[0] {
+				s.opts.CardinalityLimits.reset()
+				s.log.reportSuppressed(false)
+				if s.recorder != nil {
+					if err := s.recorder.Flush(); err != nil {
+						s.log.log(LevelError, "record", "recording failed", "file", s.opts.RecordFile, "error", err)
+					}
+				}
+			}
+		case p := <-s.in:
+			s.handlePacket(p)
+		}
+	}
+}
+
+// handlePacket filters, renames and aggregates a packet as parsed.
+func (s *Server) handlePacket(p *Packet) {
+	if p.Event != nil || p.ServiceCheck != nil {
+		s.queueEvent(p)
+		return
+	}
+	// filter rules match the bucket as sent, whatever it is renamed to
+	allowed := s.allowPacket(p)
+	s.rename(p)
+	received := *p
+	if !allowed {
+		s.taps.incoming(&received, "denied by filter")
+		return
+	}
+	if !s.limitCardinality(p) {
+		s.taps.incoming(&received, "dropped over cardinality limit")
+		return
+	}
+	if p.Bucket != received.Bucket {
+		s.taps.incoming(&received, "over cardinality limit, counted as "+p.Bucket)
+	} else {
+		s.taps.incoming(&received, "")
+	}
+	for _, w := range s.windows {
+		w.packetHandler(p)
+	}
+}
+
+// drain handles the packets still queued once the listeners are closed.
+func (s *Server) drain() {
+	for {
+		select {
+		case p := <-s.in:
+			s.handlePacket(p)
+		default:
+			return
+		}
+	}
+}
+
+// flushAll submits every window outside of its schedule, returning the first
+// error. Each send must finish by deadline, or within the window's interval
+// if it is zero. With AlignFlush, it must be the last flush, as it is
+// timestamped with the next boundary.
+func (s *Server) flushAll(deadline time.Time) error {
+	s.countRateLimited(time.Now())
+	var first error
+	for _, w := range s.windows {
+		period := time.Duration(w.interval) * time.Second
+		now := time.Now()
+		if s.opts.AlignFlush {
+			now = nextBoundary(now, period)
+		}
+		d := deadline
+		if d.IsZero() {
+			d = time.Now().Add(period)
+		}
+		if err := w.submit(now.Unix(), d); err != nil {
+			s.log.log(LevelError, "flush", "flush failed", "interval", w.interval, "error", err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// queueEvent hands an event or service check to sendEvents, dropping it
+// rather than blocking if the sinks have fallen behind.
+func (s *Server) queueEvent(p *Packet) {
+	if s.eventQueue == nil {
+		return
+	}
+	select {
+	case s.eventQueue <- p:
+	default:
+		s.log.log(LevelError, "events", "event queue full, dropping event")
+	}
+}
+
+// tickWindow sends a flushTick for w every interval until the server stops.
+func (s *Server) tickWindow(w *window, flushes chan<- flushTick) {
+	period := time.Duration(w.interval) * time.Second
+	var ticks <-chan time.Time
+	if s.opts.AlignFlush {
+		ticks = alignedTicks(period, s.stop)
+	} else {
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+	for {
+		select {
+		case tick := <-ticks:
+			select {
+			case flushes <- flushTick{w, tick}:
+			case <-s.stop:
+				return
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// alignedTicks delivers each wall-clock multiple of period as it passes, so
+// that every daemon flushes at the same offsets (:00, :10, :20, ...).
+// Like time.Ticker it drops ticks for slow receivers.
+func alignedTicks(period time.Duration, stop <-chan struct{}) <-chan time.Time {
+	ticks := make(chan time.Time, 1)
+	go func() {
+		for {
+			next := nextBoundary(time.Now(), period)
+			select {
+			case <-time.After(time.Until(next)):
+			case <-stop:
+				return
+			}
+			select {
+			case ticks <- next:
+			default:
+			}
+		}
+	}()
+	return ticks
+}
+
+// nextBoundary returns the first multiple of period since the Unix epoch
+// after t.
+func nextBoundary(t time.Time, period time.Duration) time.Time {
+	n := t.UnixNano()
+	return time.Unix(0, n-n%int64(period)+int64(period))
+}
+
+// rename applies the prefix, rewrite rules and postfix to p's bucket.
+func (s *Server) rename(p *Packet) {
+	if p.Event != nil || p.ServiceCheck != nil {
+		return
+	}
+	p.Bucket = s.opts.Prefix + s.opts.RewriteRules.rewrite(p.Bucket) + s.opts.Postfix
+}
+
+// allowPacket applies the filter rules to p, counting metrics dropped by
+// each deny rule under FilterCounter.
+func (s *Server) allowPacket(p *Packet) bool {
+	r := s.opts.FilterRules.match(p)
+	if r == nil || r.allow {
+		return true
+	}
+	if s.opts.FilterCounter != "" {
+		s.countSelf(s.opts.FilterCounter+"."+r.name, 1)
+	}
+	return false
+}
+
+// limitCardinality applies the cardinality limits to p, returning false if
+// it should be dropped. New buckets over the limit are otherwise folded into
+// the limit's overflow bucket.
+func (s *Server) limitCardinality(p *Packet) bool {
+	l := s.opts.CardinalityLimits.match(p.Bucket)
+	if l == nil || l.admit(p.Bucket) {
+		return true
+	}
+	if s.opts.CardinalityCounter != "" {
+		s.countSelf(s.opts.CardinalityCounter, 1)
+	}
+	if !l.logged {
+		s.log.log(LevelWarning, "server", "over cardinality limit", "prefix", l.prefix, "limit", l.limit, "overflow", s.opts.CardinalityOverflow)
+		l.logged = true
+	}
+	if s.opts.CardinalityOverflow == "drop" {
+		return false
+	}
+	p.Bucket = l.prefix + "__overflow__" + s.opts.Postfix
+	return true
+}
+
+// countSelf adds value to the counter bucket of every window, for metrics
+// about the daemon itself.
+func (s *Server) countSelf(bucket string, value float64) {
+	for _, w := range s.windows {
+		w.counters[bucket] += value
+	}
+}
+
+var sourceReplacer = strings.NewReplacer(".", "_", ":", "_")
+
+// countRateLimited moves the per-source drop counts of the source rate limit
+// into the counters of every window so they are flushed with everything else.
+func (s *Server) countRateLimited(now time.Time) {
+	if s.sourceLimits == nil {
+		return
+	}
+	for source, n := range s.sourceLimits.drainDropped(now) {
+		s.log.log(LevelWarning, "server", "dropped lines over source rate limit", "source", source, "count", n)
+		if s.opts.RateLimitCounter != "" {
+			s.countSelf(s.opts.RateLimitCounter+"."+sourceReplacer.Replace(source), float64(n))
+		}
+	}
+}
+
+// heartbeat creates or touches the file at path.
+func heartbeat(path string) error {
+	_, err := os.Stat(path)
+	if err != nil && os.IsNotExist(err) {
+		file, err := os.Create(path)
+		if err != nil {
+			return fmt.Errorf("creating heartbeat file - %s", err)
+		}
+		file.Close()
+	} else if err != nil {
+		return err
+	}
+
+	currentTime := time.Now()
+	if err := os.Chtimes(path, currentTime, currentTime); err != nil {
+		return fmt.Errorf("touching heartbeat file - %s", err)
+	}
+	return nil
+}
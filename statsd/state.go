@@ -0,0 +1,196 @@
+package statsd
+
+import (
+	"encoding/gob"
+	"fmt"
+	"os"
+	"time"
+)
+
+const stateVersion = 1
+
+// A StateFile holds everything the windows have aggregated but not sent yet,
+// and the inactivity bookkeeping that keeps gauges and zero counts going, so
+// that a restart doesn't reset them. It is a gob stream of a stateHeader
+// followed by one windowState per window. Sketches are stored in their binary
+// encodings.
+//
+// Periodic checkpoints leave out the counters, timers, sets and histograms:
+// the window may be flushed before the next checkpoint, and restoring them
+// after a crash would send them twice.
+type stateHeader struct {
+	Version int
+	Time    int64
+	Windows int
+}
+
+type windowState struct {
+	Interval  int64
+	LastFlush int64
+
+	Counters        map[string]float64
+	Gauges          map[string]float64
+	Timers          map[string]Float64Slice
+	TimerDigests    map[string]*TDigest
+	CountInactivity map[string]int64
+	GaugeInactivity map[string]int64
+	TimerInactivity map[string]int64
+	SetInactivity   map[string]int64
+	Sets            map[string][]string
+	SetSketches     map[string]*HyperLogLog
+
+	Histograms          map[string]Float64Slice
+	HistogramDigests    map[string]*TDigest
+	HistogramInactivity map[string]int64
+	Distributions       map[string]*TDigest
+
+	CounterHistory map[int64]map[string]float64
+	LateCounters   map[int64]map[string]bool
+	LateGauges     map[int64]map[string]float64
+}
+
+func (w *window) state() *windowState {
+	return &windowState{
+		Interval:            w.interval,
+		LastFlush:           w.lastFlush,
+		Counters:            w.counters,
+		Gauges:              w.gauges,
+		Timers:              w.timers,
+		TimerDigests:        w.timerDigests,
+		CountInactivity:     w.countInactivity,
+		GaugeInactivity:     w.gaugeInactivity,
+		TimerInactivity:     w.timerInactivity,
+		SetInactivity:       w.setInactivity,
+		Sets:                w.sets,
+		SetSketches:         w.setSketches,
+		Histograms:          w.histograms,
+		HistogramDigests:    w.histogramDigests,
+		HistogramInactivity: w.histogramInactivity,
+		Distributions:       w.distributions,
+		CounterHistory:      w.counterHistory,
+		LateCounters:        w.lateCounters,
+		LateGauges:          w.lateGauges,
+	}
+}
+
+// dropUnsent removes the aggregates that are sent once and then reset,
+// leaving what may safely be sent again.
+func (ws *windowState) dropUnsent() {
+	ws.Counters = nil
+	ws.Timers = nil
+	ws.TimerDigests = nil
+	ws.Sets = nil
+	ws.SetSketches = nil
+	ws.Histograms = nil
+	ws.HistogramDigests = nil
+	ws.Distributions = nil
+}
+
+// restore replaces what w has aggregated with ws.
+func (w *window) restore(ws *windowState) {
+	w.lastFlush = ws.LastFlush
+	w.counters = ws.Counters
+	w.gauges = ws.Gauges
+	w.timers = ws.Timers
+	w.timerDigests = ws.TimerDigests
+	w.countInactivity = ws.CountInactivity
+	w.gaugeInactivity = ws.GaugeInactivity
+	w.timerInactivity = ws.TimerInactivity
+	w.setInactivity = ws.SetInactivity
+	w.sets = ws.Sets
+	w.setSketches = ws.SetSketches
+	w.histograms = ws.Histograms
+	w.histogramDigests = ws.HistogramDigests
+	w.histogramInactivity = ws.HistogramInactivity
+	w.distributions = ws.Distributions
+	w.counterHistory = ws.CounterHistory
+	w.lateCounters = ws.LateCounters
+	w.lateGauges = ws.LateGauges
+}
+
+// saveState writes the state of every window to StateFile, replacing the
+// previous one only once the new one is complete. Unless full, the aggregates
+// still to be sent are left out.
+func (s *Server) saveState(full bool) error {
+	if s.opts.StateFile == "" {
+		return nil
+	}
+	tmp := s.opts.StateFile + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("creating state file - %s", err)
+	}
+	enc := gob.NewEncoder(file)
+	err = enc.Encode(&stateHeader{Version: stateVersion, Time: time.Now().Unix(), Windows: len(s.windows)})
+	for _, w := range s.windows {
+		if err != nil {
+			break
+		}
+		ws := w.state()
+		if !full {
+			ws.dropUnsent()
+		}
+		err = enc.Encode(ws)
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("writing state file - %s", err)
+	}
+	if err := os.Rename(tmp, s.opts.StateFile); err != nil {
+		return fmt.Errorf("writing state file - %s", err)
+	}
+	return nil
+}
+
+// loadState restores the windows from StateFile if it exists and is no older
+// than StateMaxAge. Windows are matched by position and interval, so state
+// for a window whose -window flag changed is dropped.
+func (s *Server) loadState() error {
+	file, err := os.Open(s.opts.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("reading state file - %s", err)
+	}
+	defer file.Close()
+
+	dec := gob.NewDecoder(file)
+	var header stateHeader
+	if err := dec.Decode(&header); err != nil {
+		return fmt.Errorf("reading state file %s - %s", s.opts.StateFile, err)
+	}
+	if header.Version != stateVersion {
+		return fmt.Errorf("state file %s has unknown version %d", s.opts.StateFile, header.Version)
+	}
+	age := time.Now().Unix() - header.Time
+	if age > s.opts.StateMaxAge {
+		s.log.log(LevelWarning, "state", "ignoring old state file", "file", s.opts.StateFile, "age", time.Duration(age)*time.Second)
+		return nil
+	}
+
+	// decode everything before restoring anything, so that a truncated
+	// file leaves the windows empty rather than half restored
+	var restored []*windowState
+	for i := 0; i < header.Windows; i++ {
+		// gob adds entries to the fresh maps rather than leaving them nil
+		ws := newWindow(&s.opts, 0, nil).state()
+		if err := dec.Decode(ws); err != nil {
+			return fmt.Errorf("reading state file %s - %s", s.opts.StateFile, err)
+		}
+		if i >= len(s.windows) || s.windows[i].interval != ws.Interval {
+			s.log.log(LevelWarning, "state", "dropping state, the windows have changed", "window", i, "interval", ws.Interval)
+			ws = nil
+		}
+		restored = append(restored, ws)
+	}
+	for i, ws := range restored {
+		if ws != nil {
+			s.windows[i].restore(ws)
+		}
+	}
+	s.log.log(LevelInfo, "state", "restored state", "file", s.opts.StateFile, "age", time.Duration(age)*time.Second)
+	return nil
+}
@@ -0,0 +1,123 @@
+package statsd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsdaemon")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.StateFile = filepath.Join(dir, "state")
+	opts.DeleteGauges = false
+	opts.TimerCompression = 100
+	opts.SetHLLThreshold = 2
+	opts.Windows.Set("60=-")
+
+	s := newTestServer(t, opts)
+	for _, line := range []string{"gaugor:12|g", "gorets:3|c", "glork:320|ms", "uniques:a|s", "uniques:b|s"} {
+		s.handlePacket(ParseLine([]byte(line))[0])
+	}
+	// flushed since, so only its inactivity is left
+	s.windows[0].countInactivity["old"] = 2
+	assert.Equal(t, nil, s.saveState(true))
+
+	s = newTestServer(t, opts)
+	for _, w := range s.windows {
+		assert.Equal(t, float64(12), w.gauges["gaugor"])
+		assert.Equal(t, float64(3), w.counters["gorets"])
+		assert.Equal(t, float64(1), w.timerDigests["glork"].count)
+		assert.Equal(t, 2, int(w.setSketches["uniques"].Count()))
+	}
+	assert.Equal(t, int64(2), s.windows[0].countInactivity["old"])
+	assert.Equal(t, 0, len(s.windows[1].countInactivity))
+
+	var buffer bytes.Buffer
+	s.windows[0].processGauges(&buffer, 1)
+	assert.Equal(t, "gaugor 12 1\n", buffer.String())
+
+	// state for changed windows is dropped
+	opts.Windows = nil
+	opts.Windows.Set("300=-")
+	s = newTestServer(t, opts)
+	assert.Equal(t, float64(12), s.windows[0].gauges["gaugor"])
+	assert.Equal(t, 0, len(s.windows[1].gauges))
+
+	// and so is old state
+	opts.StateMaxAge = -1
+	s = newTestServer(t, opts)
+	assert.Equal(t, 0, len(s.windows[0].gauges))
+}
+
+func TestStateCheckpointAfterFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsdaemon")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.StateFile = filepath.Join(dir, "state")
+	opts.DeleteGauges = false
+	backend := &testBackend{}
+	opts.Backend = backend
+
+	s := newTestServer(t, opts)
+	for _, line := range []string{"gaugor:12|g", "gorets:3|c", "glork:320|ms", "uniques:a|s"} {
+		s.handlePacket(ParseLine([]byte(line))[0])
+	}
+	assert.Equal(t, nil, s.saveState(false))
+	assert.Equal(t, nil, s.flushAll(time.Time{}))
+	assert.Contains(t, backend.output(), "gorets 3 ")
+
+	// as if the daemon crashed here: what was flushed isn't sent again
+	s = newTestServer(t, opts)
+	w := s.windows[0]
+	assert.Equal(t, float64(12), w.gauges["gaugor"])
+	assert.Equal(t, 0, len(w.counters))
+	assert.Equal(t, 0, len(w.timers))
+	assert.Equal(t, 0, len(w.sets))
+	// and the left out maps are still usable
+	for _, line := range []string{"later:1|c", "later:1|ms", "later:a|s", "later:1|h"} {
+		s.handlePacket(ParseLine([]byte(line))[0])
+	}
+	assert.Equal(t, float64(1), w.counters["later"])
+}
+
+func TestStateSavedOnStop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsdaemon")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.StateFile = filepath.Join(dir, "state")
+	opts.DeleteGauges = false
+	opts.Backend = &testBackend{}
+
+	s := newTestServer(t, opts)
+	assert.Equal(t, nil, s.Start())
+	s.in <- ParseLine([]byte("gaugor:12|g"))[0]
+	s.in <- ParseLine([]byte("gorets:3|c"))[0]
+	assert.Equal(t, nil, s.Stop())
+
+	// the counter was flushed on the way out, the gauge is kept going
+	s = newTestServer(t, opts)
+	assert.Equal(t, float64(12), s.windows[0].gauges["gaugor"])
+	assert.Equal(t, 0, len(s.windows[0].counters))
+	assert.Equal(t, int64(1), s.windows[0].countInactivity["gorets"])
+
+	// a broken file doesn't stop the server
+	assert.Equal(t, nil, ioutil.WriteFile(opts.StateFile, []byte("garbage"), 0644))
+	s = newTestServer(t, opts)
+	assert.Equal(t, 0, len(s.windows[0].gauges))
+
+	_, err = os.Stat(opts.StateFile + ".tmp")
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,1854 @@
+package statsd
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var commonPercentiles = Percentiles{
+	&Percentile{
+		99,
+		"99",
+	},
+}
+
+func newTestServer(t *testing.T, opts Options) *Server {
+	s, err := NewServer(opts)
+	assert.Equal(t, nil, err)
+	return s
+}
+
+// testBackend collects what windows send to it, or fails to dial with err.
+type testBackend struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+	err error
+}
+
+func (b *testBackend) Dial(deadline time.Time) (io.WriteCloser, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	return b, nil
+}
+
+func (b *testBackend) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *testBackend) Close() error { return nil }
+
+func (b *testBackend) String() string { return "test" }
+
+func (b *testBackend) output() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+type TestUdpReader struct {
+	Pattern []byte
+}
+
+func (r *TestUdpReader) Read(p []byte) (int, error) {
+	return copy(p, r.Pattern), nil
+}
+
+type TestTcpReader struct {
+	Pattern  []byte
+	ReadSize int
+	off      int
+}
+
+func (r *TestTcpReader) Read(p []byte) (int, error) {
+	poff := 0
+	end := r.ReadSize
+	if end > len(p) {
+		end = len(p)
+	}
+	for poff < end {
+		c := copy(p[poff:end], r.Pattern[r.off:])
+		poff += c
+		r.off += c
+		if r.off == len(r.Pattern) {
+			r.off = 0
+		}
+	}
+	return end, nil
+}
+
+func TestParseLineGauge(t *testing.T) {
+	d := []byte("gaugor:333|g")
+	packet := ParseLine(d)[0]
+	assert.NotEqual(t, packet, nil)
+	assert.Equal(t, "gaugor", packet.Bucket)
+	assert.Equal(t, float64(333), packet.ValFlt)
+	assert.Equal(t, "", packet.ValStr)
+	assert.Equal(t, "g", packet.Modifier)
+	assert.Equal(t, float32(1), packet.Sampling)
+
+	d = []byte("gaugor:-10|g")
+	packet = ParseLine(d)[0]
+	assert.NotEqual(t, packet, nil)
+	assert.Equal(t, "gaugor", packet.Bucket)
+	assert.Equal(t, float64(10), packet.ValFlt)
+	assert.Equal(t, "-", packet.ValStr)
+	assert.Equal(t, "g", packet.Modifier)
+	assert.Equal(t, float32(1), packet.Sampling)
+
+	d = []byte("gaugor:+4|g")
+	packet = ParseLine(d)[0]
+	assert.NotEqual(t, packet, nil)
+	assert.Equal(t, "gaugor", packet.Bucket)
+	assert.Equal(t, float64(4), packet.ValFlt)
+	assert.Equal(t, "+", packet.ValStr)
+	assert.Equal(t, "g", packet.Modifier)
+	assert.Equal(t, float32(1), packet.Sampling)
+
+	// >max(int64) && <max(uint64)
+	d = []byte("gaugor:18446744073709551606|g")
+	packet = ParseLine(d)[0]
+	assert.NotEqual(t, packet, nil)
+	assert.Equal(t, "gaugor", packet.Bucket)
+	assert.Equal(t, float64(18446744073709551606), packet.ValFlt)
+	assert.Equal(t, "", packet.ValStr)
+	assert.Equal(t, "g", packet.Modifier)
+	assert.Equal(t, float32(1), packet.Sampling)
+
+	// float values
+	d = []byte("gaugor:3.3333|g")
+	packet = ParseLine(d)[0]
+	assert.NotEqual(t, packet, nil)
+	assert.Equal(t, "gaugor", packet.Bucket)
+	assert.Equal(t, float64(3.3333), packet.ValFlt)
+	assert.Equal(t, "", packet.ValStr)
+	assert.Equal(t, "g", packet.Modifier)
+	assert.Equal(t, float32(1), packet.Sampling)
+}
+
+func TestParseLineCount(t *testing.T) {
+	d := []byte("gorets:2|c|@0.1")
+	packet := ParseLine(d)[0]
+	assert.NotEqual(t, packet, nil)
+	assert.Equal(t, "gorets", packet.Bucket)
+	assert.Equal(t, float64(2), packet.ValFlt)
+	assert.Equal(t, "c", packet.Modifier)
+	assert.Equal(t, float32(0.1), packet.Sampling)
+
+	d = []byte("gorets:4|c")
+	packet = ParseLine(d)[0]
+	assert.NotEqual(t, packet, nil)
+	assert.Equal(t, "gorets", packet.Bucket)
+	assert.Equal(t, float64(4), packet.ValFlt)
+	assert.Equal(t, "c", packet.Modifier)
+	assert.Equal(t, float32(1), packet.Sampling)
+
+	d = []byte("gorets:-4|c")
+	packet = ParseLine(d)[0]
+	assert.NotEqual(t, packet, nil)
+	assert.Equal(t, "gorets", packet.Bucket)
+	assert.Equal(t, float64(-4), packet.ValFlt)
+	assert.Equal(t, "c", packet.Modifier)
+	assert.Equal(t, float32(1), packet.Sampling)
+
+	d = []byte("gorets:1.25|c")
+	packet = ParseLine(d)[0]
+	assert.NotEqual(t, packet, nil)
+	assert.Equal(t, "gorets", packet.Bucket)
+	assert.Equal(t, 1.25, packet.ValFlt)
+	assert.Equal(t, "c", packet.Modifier)
+	assert.Equal(t, float32(1), packet.Sampling)
+}
+
+func TestParseLineTimer(t *testing.T) {
+	d := []byte("glork:320|ms")
+	packet := ParseLine(d)[0]
+	assert.NotEqual(t, packet, nil)
+	assert.Equal(t, "glork", packet.Bucket)
+	assert.Equal(t, float64(320), packet.ValFlt)
+	assert.Equal(t, "ms", packet.Modifier)
+	assert.Equal(t, float32(1), packet.Sampling)
+
+	d = []byte("glork:320|ms|@0.1")
+	packet = ParseLine(d)[0]
+	assert.NotEqual(t, packet, nil)
+	assert.Equal(t, "glork", packet.Bucket)
+	assert.Equal(t, float64(320), packet.ValFlt)
+	assert.Equal(t, "ms", packet.Modifier)
+	assert.Equal(t, float32(0.1), packet.Sampling)
+
+	d = []byte("glork:3.7211|ms")
+	packet = ParseLine(d)[0]
+	assert.NotEqual(t, packet, nil)
+	assert.Equal(t, "glork", packet.Bucket)
+	assert.Equal(t, float64(3.7211), packet.ValFlt)
+	assert.Equal(t, "ms", packet.Modifier)
+	assert.Equal(t, float32(1), packet.Sampling)
+}
+
+func TestParseLineMultiValue(t *testing.T) {
+	d := []byte("glork:1|c:2|c|@0.5:300|ms")
+	packets := ParseLine(d)
+	assert.Equal(t, 3, len(packets))
+	assert.Equal(t, "glork", packets[0].Bucket)
+	assert.Equal(t, float64(1), packets[0].ValFlt)
+	assert.Equal(t, "c", packets[0].Modifier)
+	assert.Equal(t, float32(1), packets[0].Sampling)
+	assert.Equal(t, "glork", packets[1].Bucket)
+	assert.Equal(t, float64(2), packets[1].ValFlt)
+	assert.Equal(t, "c", packets[1].Modifier)
+	assert.Equal(t, float32(0.5), packets[1].Sampling)
+	assert.Equal(t, "glork", packets[2].Bucket)
+	assert.Equal(t, float64(300), packets[2].ValFlt)
+	assert.Equal(t, "ms", packets[2].Modifier)
+	assert.Equal(t, float32(1), packets[2].Sampling)
+
+	d = []byte("gaugor:+4|g:uniq|s:7|g|T1418052649")
+	packets = ParseLine(d)
+	assert.Equal(t, 3, len(packets))
+	assert.Equal(t, "+", packets[0].ValStr)
+	assert.Equal(t, "uniq", packets[1].ValStr)
+	assert.Equal(t, "s", packets[1].Modifier)
+	assert.Equal(t, float64(7), packets[2].ValFlt)
+	assert.Equal(t, int64(1418052649), packets[2].Timestamp)
+
+	// colons in tags and container ids don't start a new value
+	d = []byte("gorets:2|c|#env:prod|c:83f1a2")
+	packets = ParseLine(d)
+	assert.Equal(t, 1, len(packets))
+	assert.Equal(t, float64(2), packets[0].ValFlt)
+
+	// a bad value is skipped without losing the rest of the line
+	d = []byte("glork:1|c:xxx|c:3|z:4|ms:5")
+	packets = ParseLine(d)
+	assert.Equal(t, 2, len(packets))
+	assert.Equal(t, float64(1), packets[0].ValFlt)
+	assert.Equal(t, float64(4), packets[1].ValFlt)
+	assert.Equal(t, "ms", packets[1].Modifier)
+
+	// every value gets the same sanitized bucket
+	d = []byte("a b!c:1|c:2|c")
+	packets = ParseLine(d)
+	assert.Equal(t, 2, len(packets))
+	assert.Equal(t, "a_bc", packets[0].Bucket)
+	assert.Equal(t, "a_bc", packets[1].Bucket)
+	assert.Equal(t, "a b!c:1|c:2|c", string(d))
+
+	parser := NewParser(bytes.NewBuffer([]byte("glork:1|c:2|c\ngauge:3|g")), true, 1472)
+	packet, more := parser.Next()
+	assert.Equal(t, true, more)
+	assert.Equal(t, float64(1), packet.ValFlt)
+	packet, more = parser.Next()
+	assert.Equal(t, true, more)
+	assert.Equal(t, float64(2), packet.ValFlt)
+	packet, more = parser.Next()
+	assert.Equal(t, false, more)
+	assert.Equal(t, "gauge", packet.Bucket)
+
+	parser = NewParser(bytes.NewBuffer([]byte("gauge:3|g\nglork:1|c:2|c")), true, 1472)
+	packet, more = parser.Next()
+	assert.Equal(t, true, more)
+	assert.Equal(t, "gauge", packet.Bucket)
+	packet, more = parser.Next()
+	assert.Equal(t, true, more)
+	assert.Equal(t, float64(1), packet.ValFlt)
+	packet, more = parser.Next()
+	assert.Equal(t, false, more)
+	assert.Equal(t, float64(2), packet.ValFlt)
+}
+
+func TestParseLineHistogram(t *testing.T) {
+	d := []byte("glork:320|h|@0.1")
+	packet := ParseLine(d)[0]
+	assert.NotEqual(t, packet, nil)
+	assert.Equal(t, "glork", packet.Bucket)
+	assert.Equal(t, float64(320), packet.ValFlt)
+	assert.Equal(t, "h", packet.Modifier)
+	assert.Equal(t, float32(0.1), packet.Sampling)
+
+	d = []byte("glork:3.7211|d|#env:prod")
+	packet = ParseLine(d)[0]
+	assert.NotEqual(t, packet, nil)
+	assert.Equal(t, float64(3.7211), packet.ValFlt)
+	assert.Equal(t, "d", packet.Modifier)
+	assert.Equal(t, float32(1), packet.Sampling)
+
+	d = []byte("glork:fast|h")
+	if len(ParseLine(d)) != 0 {
+		t.Fail()
+	}
+}
+
+func TestParseLineTimestamp(t *testing.T) {
+	d := []byte("gorets:2|c|@0.5|#env:prod,role:api|T1418052649")
+	packet := ParseLine(d)[0]
+	assert.NotEqual(t, packet, nil)
+	assert.Equal(t, "gorets", packet.Bucket)
+	assert.Equal(t, float64(2), packet.ValFlt)
+	assert.Equal(t, "c", packet.Modifier)
+	assert.Equal(t, float32(0.5), packet.Sampling)
+	assert.Equal(t, int64(1418052649), packet.Timestamp)
+
+	d = []byte("gaugor:333|g|T1418052649")
+	packet = ParseLine(d)[0]
+	assert.NotEqual(t, packet, nil)
+	assert.Equal(t, float64(333), packet.ValFlt)
+	assert.Equal(t, int64(1418052649), packet.Timestamp)
+
+	d = []byte("gaugor:333|g")
+	packet = ParseLine(d)[0]
+	assert.Equal(t, int64(0), packet.Timestamp)
+
+	d = []byte("gaugor:333|g|Tnow")
+	if len(ParseLine(d)) != 0 {
+		t.Fail()
+	}
+}
+
+func TestParseLineSet(t *testing.T) {
+	d := []byte("uniques:765|s")
+	packet := ParseLine(d)[0]
+	assert.NotEqual(t, packet, nil)
+	assert.Equal(t, "uniques", packet.Bucket)
+	assert.Equal(t, "765", packet.ValStr)
+	assert.Equal(t, "s", packet.Modifier)
+	assert.Equal(t, float32(1), packet.Sampling)
+}
+
+func TestParseLineMisc(t *testing.T) {
+	d := []byte("a.key.with-0.dash:4|c")
+	packet := ParseLine(d)[0]
+	assert.NotEqual(t, packet, nil)
+	assert.Equal(t, "a.key.with-0.dash", packet.Bucket)
+	assert.Equal(t, float64(4), packet.ValFlt)
+	assert.Equal(t, "c", packet.Modifier)
+	assert.Equal(t, float32(1), packet.Sampling)
+
+	d = []byte("a.key.with 0.space:4|c")
+	packet = ParseLine(d)[0]
+	assert.Equal(t, "a.key.with_0.space", packet.Bucket)
+	assert.Equal(t, float64(4), packet.ValFlt)
+	assert.Equal(t, "c", packet.Modifier)
+	assert.Equal(t, float32(1), packet.Sampling)
+
+	d = []byte("a.key.with/0.slash:4|c")
+	packet = ParseLine(d)[0]
+	assert.Equal(t, "a.key.with-0.slash", packet.Bucket)
+	assert.Equal(t, float64(4), packet.ValFlt)
+	assert.Equal(t, "c", packet.Modifier)
+	assert.Equal(t, float32(1), packet.Sampling)
+
+	d = []byte("a.key.with@#*&%$^_0.garbage:4|c")
+	packet = ParseLine(d)[0]
+	assert.Equal(t, "a.key.with_0.garbage", packet.Bucket)
+	assert.Equal(t, float64(4), packet.ValFlt)
+	assert.Equal(t, "c", packet.Modifier)
+	assert.Equal(t, float32(1), packet.Sampling)
+
+	opts := DefaultOptions()
+	opts.Prefix = "test."
+	opts.RewriteRules.Set(`regex ^servers\.([^.]+)\.(.+)$ $2.$1`)
+	s := newTestServer(t, opts)
+	d = []byte("prefix:4|c")
+	packet = ParseLine(d)[0]
+	s.rename(packet)
+	assert.Equal(t, "test.prefix", packet.Bucket)
+	assert.Equal(t, float64(4), packet.ValFlt)
+	assert.Equal(t, "c", packet.Modifier)
+	assert.Equal(t, float32(1), packet.Sampling)
+
+	d = []byte("servers.host1.api/latency:4|c")
+	packet = ParseLine(d)[0]
+	s.rename(packet)
+	assert.Equal(t, "test.api-latency.host1", packet.Bucket)
+
+	opts = DefaultOptions()
+	opts.Postfix = ".test"
+	s = newTestServer(t, opts)
+	d = []byte("postfix:4|c")
+	packet = ParseLine(d)[0]
+	s.rename(packet)
+	assert.Equal(t, "postfix.test", packet.Bucket)
+	assert.Equal(t, float64(4), packet.ValFlt)
+	assert.Equal(t, "c", packet.Modifier)
+	assert.Equal(t, float32(1), packet.Sampling)
+
+	d = []byte("a.key.with-0.dash:4|c\ngauge:3|g")
+	parser := NewParser(bytes.NewBuffer(d), true, 1472)
+	packet, more := parser.Next()
+	assert.Equal(t, more, true)
+	assert.Equal(t, "a.key.with-0.dash", packet.Bucket)
+	assert.Equal(t, float64(4), packet.ValFlt)
+	assert.Equal(t, "c", packet.Modifier)
+	assert.Equal(t, float32(1), packet.Sampling)
+
+	packet, more = parser.Next()
+	assert.Equal(t, more, false)
+	assert.Equal(t, "gauge", packet.Bucket)
+	assert.Equal(t, 3.0, packet.ValFlt)
+	assert.Equal(t, "", packet.ValStr)
+	assert.Equal(t, "g", packet.Modifier)
+	assert.Equal(t, float32(1), packet.Sampling)
+
+	d = []byte("a.key.with-0.dash:4\ngauge3|g")
+	if len(ParseLine(d)) != 0 {
+		t.Fail()
+	}
+
+	d = []byte("a.key.with-0.dash:4")
+	if len(ParseLine(d)) != 0 {
+		t.Fail()
+	}
+
+	d = []byte("gorets:5m")
+	if len(ParseLine(d)) != 0 {
+		t.Fail()
+	}
+
+	d = []byte("gorets")
+	if len(ParseLine(d)) != 0 {
+		t.Fail()
+	}
+
+	d = []byte("gorets:")
+	if len(ParseLine(d)) != 0 {
+		t.Fail()
+	}
+
+	d = []byte("gorets:5|mg")
+	if len(ParseLine(d)) != 0 {
+		t.Fail()
+	}
+
+	d = []byte("gorets:5|ms|@")
+	if len(ParseLine(d)) != 0 {
+		t.Fail()
+	}
+
+	d = []byte("")
+	if len(ParseLine(d)) != 0 {
+		t.Fail()
+	}
+
+	d = []byte("gorets:xxx|c")
+	if len(ParseLine(d)) != 0 {
+		t.Fail()
+	}
+
+	d = []byte("gaugor:xxx|g")
+	if len(ParseLine(d)) != 0 {
+		t.Fail()
+	}
+
+	d = []byte("gaugor:xxx|z")
+	if len(ParseLine(d)) != 0 {
+		t.Fail()
+	}
+
+	d = []byte("deploys.test.myservice4:100|t")
+	if len(ParseLine(d)) != 0 {
+		t.Fail()
+	}
+
+	d = []byte("up-to-colon:")
+	if len(ParseLine(d)) != 0 {
+		t.Fail()
+	}
+
+	d = []byte("up-to-pipe:1|")
+	if len(ParseLine(d)) != 0 {
+		t.Fail()
+	}
+}
+
+func TestMultiLine(t *testing.T) {
+	b := bytes.NewBuffer([]byte("a.key.with-0.dash:4|c\ngauge:3|g"))
+	parser := NewParser(b, true, 1472)
+
+	checkTwoPackets(t, parser, false)
+}
+
+func checkTwoPackets(t *testing.T, parser *MsgParser, inf bool) {
+	packet, more := parser.Next()
+	assert.NotEqual(t, packet, nil)
+	assert.Equal(t, more, true)
+	assert.Equal(t, "a.key.with-0.dash", packet.Bucket)
+	assert.Equal(t, float64(4), packet.ValFlt)
+	assert.Equal(t, "c", packet.Modifier)
+	assert.Equal(t, float32(1), packet.Sampling)
+
+	packet, more = parser.Next()
+	assert.NotEqual(t, packet, nil)
+	assert.Equal(t, more, inf)
+	assert.Equal(t, "gauge", packet.Bucket)
+	assert.Equal(t, 3.0, packet.ValFlt)
+	assert.Equal(t, "", packet.ValStr)
+	assert.Equal(t, "g", packet.Modifier)
+	assert.Equal(t, float32(1), packet.Sampling)
+}
+
+func TestMultiUdp(t *testing.T) {
+	r := &TestUdpReader{[]byte("a.key.with-0.dash:4|c\ngauge:3|g")}
+	parser := NewParser(r, false, 1472)
+
+	checkTwoPackets(t, parser, true)
+	checkTwoPackets(t, parser, true)
+	checkTwoPackets(t, parser, true)
+}
+
+func TestMultiTcp(t *testing.T) {
+	// reads 16 bytes at a time
+	r := &TestTcpReader{[]byte("a.key.with-0.dash:4|c\ngauge:3|g\n"), 16, 0}
+	parser := NewParser(r, true, 1472)
+
+	checkTwoPackets(t, parser, true)
+	checkTwoPackets(t, parser, true)
+	checkTwoPackets(t, parser, true)
+}
+
+func TestPacketHandlerReceiveCounter(t *testing.T) {
+	opts := DefaultOptions()
+	w := newWindow(&opts, 10, nil)
+	opts.ReceiveCounter = "countme"
+
+	p := &Packet{
+		Bucket:   "gorets",
+		ValFlt:   100,
+		Modifier: "c",
+		Sampling: float32(1),
+	}
+	w.packetHandler(p)
+	assert.Equal(t, w.counters["countme"], float64(1))
+
+	w.packetHandler(p)
+	assert.Equal(t, w.counters["countme"], float64(2))
+}
+
+func TestAllowPacket(t *testing.T) {
+	opts := DefaultOptions()
+	opts.FilterRules.Set("allow glob noisy.keep")
+	opts.FilterRules.Set("deny glob noisy.*")
+	opts.FilterCounter = "statsdaemon.filtered"
+	s := newTestServer(t, opts)
+	w := s.windows[0]
+
+	p := &Packet{
+		Bucket:   "noisy.drop",
+		ValFlt:   1,
+		Modifier: "c",
+		Sampling: float32(1),
+	}
+	assert.Equal(t, s.allowPacket(p), false)
+	assert.Equal(t, s.allowPacket(p), false)
+	assert.Equal(t, w.counters["statsdaemon.filtered.rule2"], float64(2))
+
+	p.Bucket = "noisy.keep"
+	assert.Equal(t, s.allowPacket(p), true)
+	p.Bucket = "quiet"
+	assert.Equal(t, s.allowPacket(p), true)
+}
+
+func TestFilterBeforeRename(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Prefix = "myapp."
+	opts.RewriteRules.Set("regex ^noisy\\. quiet.")
+	opts.FilterRules.Set("deny glob noisy.drop")
+	s := newTestServer(t, opts)
+	w := s.windows[0]
+
+	for _, line := range []string{"noisy.drop:1|c", "noisy.keep:1|c"} {
+		s.handlePacket(ParseLine([]byte(line))[0])
+	}
+	assert.Equal(t, map[string]float64{"myapp.quiet.keep": 1}, w.counters)
+}
+
+func TestLimitCardinality(t *testing.T) {
+	opts := DefaultOptions()
+	opts.CardinalityLimits.Set("servers.=1")
+	opts.CardinalityCounter = "statsdaemon.over_limit"
+	s := newTestServer(t, opts)
+	w := s.windows[0]
+
+	p := &Packet{
+		Bucket:   "servers.a",
+		ValFlt:   1,
+		Modifier: "c",
+		Sampling: float32(1),
+	}
+	assert.Equal(t, s.limitCardinality(p), true)
+	assert.Equal(t, p.Bucket, "servers.a")
+
+	p.Bucket = "servers.b"
+	assert.Equal(t, s.limitCardinality(p), true)
+	assert.Equal(t, p.Bucket, "servers.__overflow__")
+
+	s.opts.CardinalityOverflow = "drop"
+	p.Bucket = "servers.c"
+	assert.Equal(t, s.limitCardinality(p), false)
+	assert.Equal(t, w.counters["statsdaemon.over_limit"], float64(2))
+
+	p.Bucket = "api.latency"
+	assert.Equal(t, s.limitCardinality(p), true)
+}
+
+func TestPacketHandlerCount(t *testing.T) {
+	opts := DefaultOptions()
+	w := newWindow(&opts, 10, nil)
+
+	p := &Packet{
+		Bucket:   "gorets",
+		ValFlt:   100,
+		Modifier: "c",
+		Sampling: float32(1),
+	}
+	w.packetHandler(p)
+	assert.Equal(t, w.counters["gorets"], float64(100))
+
+	p.ValFlt = float64(3)
+	w.packetHandler(p)
+	assert.Equal(t, w.counters["gorets"], float64(103))
+
+	p.ValFlt = float64(-4)
+	w.packetHandler(p)
+	assert.Equal(t, w.counters["gorets"], float64(99))
+
+	p.ValFlt = float64(-100)
+	w.packetHandler(p)
+	assert.Equal(t, w.counters["gorets"], float64(-1))
+}
+
+func TestPacketHandlerGauge(t *testing.T) {
+	opts := DefaultOptions()
+	w := newWindow(&opts, 10, nil)
+
+	p := &Packet{
+		Bucket:   "gaugor",
+		ValFlt:   333,
+		ValStr:   "",
+		Modifier: "g",
+		Sampling: float32(1),
+	}
+	w.packetHandler(p)
+	assert.Equal(t, w.gauges["gaugor"], float64(333))
+
+	// -10
+	p.ValFlt = 10
+	p.ValStr = "-"
+	w.packetHandler(p)
+	assert.Equal(t, w.gauges["gaugor"], float64(323))
+
+	// +4
+	p.ValFlt = 4
+	p.ValStr = "+"
+	w.packetHandler(p)
+	assert.Equal(t, w.gauges["gaugor"], float64(327))
+
+	// <0 overflow
+	p.ValFlt = 10
+	p.ValStr = ""
+	w.packetHandler(p)
+	p.ValFlt = 20
+	p.ValStr = "-"
+	w.packetHandler(p)
+	assert.Equal(t, w.gauges["gaugor"], float64(0))
+
+	// >MaxFloat64 overflow
+	p.ValFlt = float64(math.MaxFloat64 - 10)
+	p.ValStr = ""
+	w.packetHandler(p)
+	p.ValFlt = 20
+	p.ValStr = "+"
+	w.packetHandler(p)
+	assert.Equal(t, w.gauges["gaugor"], float64(math.MaxFloat64))
+}
+
+func TestPacketHandlerTimer(t *testing.T) {
+	opts := DefaultOptions()
+	w := newWindow(&opts, 10, nil)
+
+	p := &Packet{
+		Bucket:   "glork",
+		ValFlt:   float64(320),
+		Modifier: "ms",
+		Sampling: float32(1),
+	}
+	w.packetHandler(p)
+	assert.Equal(t, len(w.timers["glork"]), 1)
+	assert.Equal(t, w.timers["glork"][0], float64(320))
+
+	p.ValFlt = float64(100)
+	w.packetHandler(p)
+	assert.Equal(t, len(w.timers["glork"]), 2)
+	assert.Equal(t, w.timers["glork"][1], float64(100))
+}
+
+func TestPacketHandlerSet(t *testing.T) {
+	opts := DefaultOptions()
+	w := newWindow(&opts, 10, nil)
+
+	p := &Packet{
+		Bucket:   "uniques",
+		ValStr:   "765",
+		Modifier: "s",
+		Sampling: float32(1),
+	}
+	w.packetHandler(p)
+	assert.Equal(t, len(w.sets["uniques"]), 1)
+	assert.Equal(t, w.sets["uniques"][0], "765")
+
+	p.ValStr = "567"
+	w.packetHandler(p)
+	assert.Equal(t, len(w.sets["uniques"]), 2)
+	assert.Equal(t, w.sets["uniques"][1], "567")
+}
+
+func TestProcessCounters(t *testing.T) {
+	opts := DefaultOptions()
+	opts.PersistCountKeys = 10
+	w := newWindow(&opts, 10, nil)
+	var buffer bytes.Buffer
+	now := int64(1418052649)
+
+	w.counters["gorets"] = float64(123)
+
+	num := w.processCounters(&buffer, now)
+	assert.Equal(t, num, int64(1))
+	assert.Equal(t, buffer.String(), "gorets 123 1418052649\n")
+
+	// run w.processCounters() enough times to make sure it purges items
+	for i := 0; i < int(opts.PersistCountKeys)+10; i++ {
+		num = w.processCounters(&buffer, now)
+	}
+	lines := bytes.Split(buffer.Bytes(), []byte("\n"))
+
+	// expect two more lines - the good one and an empty one at the end
+	assert.Equal(t, len(lines), int(opts.PersistCountKeys+2))
+	assert.Equal(t, string(lines[0]), "gorets 123 1418052649")
+	assert.Equal(t, string(lines[opts.PersistCountKeys]), "gorets 0 1418052649")
+}
+
+func TestProcessCountersRates(t *testing.T) {
+	opts := DefaultOptions()
+	opts.CounterRates = true
+	opts.Postfix = ".test"
+	opts.PersistCountKeys = 1
+	w := newWindow(&opts, 10, nil)
+	var buffer bytes.Buffer
+	now := int64(1418052649)
+
+	w.counters["gorets.test"] = float64(123)
+
+	num := w.processCounters(&buffer, now)
+	assert.Equal(t, num, int64(2))
+	assert.Equal(t, buffer.String(), "gorets.test 123 1418052649\ngorets_ps.test 12.3 1418052649\n")
+
+	buffer.Reset()
+	num = w.processCounters(&buffer, now)
+	assert.Equal(t, num, int64(2))
+	assert.Equal(t, buffer.String(), "gorets.test 0 1418052649\ngorets_ps.test 0 1418052649\n")
+
+	opts.RateSuffix = ".rate"
+	buffer.Reset()
+	w.counters["gorets.test"] = float64(5)
+	w.processCounters(&buffer, now)
+	assert.Equal(t, buffer.String(), "gorets.test 5 1418052649\ngorets.rate.test 0.5 1418052649\n")
+}
+
+func TestClientTimestampsAggregateNeedsAlignFlush(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ClientTimestamps = "aggregate"
+	_, err := NewServer(opts)
+	assert.NotEqual(t, nil, err)
+
+	opts.AlignFlush = true
+	_, err = NewServer(opts)
+	assert.Equal(t, nil, err)
+}
+
+func TestClientTimestampsAggregate(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ClientTimestamps = "aggregate"
+	opts.AlignFlush = true
+	w := newWindow(&opts, 10, nil)
+	now := int64(1418052650)
+	var buffer bytes.Buffer
+
+	p := &Packet{
+		Bucket:   "gorets",
+		ValFlt:   5,
+		Modifier: "c",
+		Sampling: float32(1),
+	}
+	w.packetHandler(p)
+	w.lastFlush = now
+	w.processCounters(&buffer, now)
+
+	// late for the interval ending at now
+	p.Timestamp = now - 3
+	w.packetHandler(p)
+	// belongs to the current interval
+	p.Timestamp = now + 3
+	w.packetHandler(p)
+	// too late, counted as current
+	p.Timestamp = now - 100
+	w.packetHandler(p)
+
+	g := &Packet{
+		Bucket:    "gaugor",
+		ValFlt:    7,
+		Modifier:  "g",
+		Sampling:  float32(1),
+		Timestamp: now - 15,
+	}
+	w.packetHandler(g)
+
+	buffer.Reset()
+	w.lastFlush = now + 10
+	w.processCounters(&buffer, now+10)
+	assert.Contains(t, buffer.String(), "gorets 10 1418052660\n")
+	assert.Contains(t, buffer.String(), "gorets 10 1418052650\n")
+
+	buffer.Reset()
+	w.processGauges(&buffer, now+10)
+	assert.Equal(t, buffer.String(), "gaugor 7 1418052640\n")
+	assert.Equal(t, len(w.gauges), 0)
+
+	// history is forgotten after -max-lateness
+	w.processCounters(&buffer, now+100)
+	assert.Equal(t, len(w.counterHistory), 0)
+}
+
+func TestClientTimestampsForward(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ClientTimestamps = "forward"
+	w := newWindow(&opts, 10, nil)
+	now := int64(1418052650)
+	var buffer bytes.Buffer
+
+	p := &Packet{
+		Bucket:    "gorets",
+		ValFlt:    5,
+		Modifier:  "c",
+		Sampling:  float32(1),
+		Timestamp: now + 3,
+	}
+	w.packetHandler(p)
+	w.packetHandler(p)
+	p.Timestamp = 0
+	w.packetHandler(p)
+
+	w.processCounters(&buffer, now+10)
+	assert.Contains(t, buffer.String(), "gorets 5 1418052660\n")
+	assert.Contains(t, buffer.String(), "gorets 10 1418052653\n")
+}
+
+func TestProcessTimers(t *testing.T) {
+	opts := DefaultOptions()
+	// Some data with expected mean of 20
+	w := newWindow(&opts, 10, nil)
+	w.timers["response_time"] = []float64{0, 30, 30}
+
+	now := int64(1418052649)
+
+	var buffer bytes.Buffer
+	num := w.processTimers(&buffer, now, Percentiles{})
+
+	lines := bytes.Split(buffer.Bytes(), []byte("\n"))
+
+	assert.Equal(t, num, int64(1))
+	assert.Equal(t, string(lines[0]), "response_time.mean 20 1418052649")
+	assert.Equal(t, string(lines[1]), "response_time.upper 30 1418052649")
+	assert.Equal(t, string(lines[2]), "response_time.lower 0 1418052649")
+	assert.Equal(t, string(lines[3]), "response_time.count 3 1418052649")
+
+	num = w.processTimers(&buffer, now, Percentiles{})
+	assert.Equal(t, num, int64(0))
+}
+
+func TestProcessTimersExtendedStats(t *testing.T) {
+	opts := DefaultOptions()
+	opts.TimerStats.Set("mean_N,sum_N,sum_squares_N,count_ps,median,std,sum,sum_squares")
+	w := newWindow(&opts, 10, nil)
+	w.timers["response_time"] = []float64{4, 1, 3, 2}
+
+	now := int64(1418052649)
+
+	var buffer bytes.Buffer
+	num := w.processTimers(&buffer, now, Percentiles{
+		&Percentile{
+			75,
+			"75",
+		},
+	})
+
+	lines := bytes.Split(buffer.Bytes(), []byte("\n"))
+
+	assert.Equal(t, num, int64(1))
+	assert.Equal(t, string(lines[0]), "response_time.mean_75 2 1418052649")
+	assert.Equal(t, string(lines[1]), "response_time.sum_75 6 1418052649")
+	assert.Equal(t, string(lines[2]), "response_time.sum_squares_75 14 1418052649")
+	assert.Equal(t, string(lines[3]), "response_time.count_ps 0.4 1418052649")
+	assert.Equal(t, string(lines[4]), "response_time.median 2.5 1418052649")
+	assert.Equal(t, string(lines[5]), "response_time.std 1.118033988749895 1418052649")
+	assert.Equal(t, string(lines[6]), "response_time.sum 10 1418052649")
+	assert.Equal(t, string(lines[7]), "response_time.sum_squares 30 1418052649")
+	assert.Equal(t, len(lines), 9)
+
+	assert.NotEqual(t, opts.TimerStats.Set("mean,bogus"), nil)
+	// a bad value leaves the stats alone
+	assert.Equal(t, "mean_N,sum_N,sum_squares_N,count_ps,median,std,sum,sum_squares", opts.TimerStats.String())
+}
+
+func TestProcessTimerDigests(t *testing.T) {
+	opts := DefaultOptions()
+	opts.TimerCompression = 100
+	w := newWindow(&opts, 10, nil)
+
+	p := &Packet{
+		Bucket:   "response_time",
+		Modifier: "ms",
+		Sampling: float32(1),
+	}
+	for _, v := range []float64{0, 30, 30} {
+		p.ValFlt = v
+		w.packetHandler(p)
+	}
+	assert.Equal(t, len(w.timers), 0)
+	assert.Equal(t, w.timerDigests["response_time"].Count(), float64(3))
+
+	now := int64(1418052649)
+
+	var buffer bytes.Buffer
+	num := w.processTimers(&buffer, now, Percentiles{})
+
+	lines := bytes.Split(buffer.Bytes(), []byte("\n"))
+
+	assert.Equal(t, num, int64(1))
+	assert.Equal(t, string(lines[0]), "response_time.mean 20 1418052649")
+	assert.Equal(t, string(lines[1]), "response_time.upper 30 1418052649")
+	assert.Equal(t, string(lines[2]), "response_time.lower 0 1418052649")
+	assert.Equal(t, string(lines[3]), "response_time.count 3 1418052649")
+
+	num = w.processTimers(&buffer, now, Percentiles{})
+	assert.Equal(t, num, int64(0))
+}
+
+func TestProcessGauges(t *testing.T) {
+	opts := DefaultOptions()
+	opts.DeleteGauges = false
+	w := newWindow(&opts, 10, nil)
+	var buffer bytes.Buffer
+
+	now := int64(1418052649)
+
+	num := w.processGauges(&buffer, now)
+	assert.Equal(t, num, int64(0))
+	assert.Equal(t, buffer.String(), "")
+
+	p := &Packet{
+		Bucket:   "gaugor",
+		ValFlt:   12345,
+		ValStr:   "",
+		Modifier: "g",
+		Sampling: 1.0,
+	}
+	w.packetHandler(p)
+	num = w.processGauges(&buffer, now)
+	assert.Equal(t, num, int64(1))
+	num = w.processGauges(&buffer, now+20)
+	assert.Equal(t, num, int64(1))
+	assert.Equal(t, buffer.String(), "gaugor 12345 1418052649\ngaugor 12345 1418052669\n")
+
+	buffer = bytes.Buffer{}
+	p.ValFlt = 12346.75
+	w.packetHandler(p)
+	p.ValFlt = 12347.25
+	w.packetHandler(p)
+	num = w.processGauges(&buffer, now+40)
+	assert.Equal(t, num, int64(1))
+	assert.Equal(t, buffer.String(), "gaugor 12347.25 1418052689\n")
+}
+
+func TestProcessDeleteGauges(t *testing.T) {
+	opts := DefaultOptions()
+	opts.DeleteGauges = true
+	w := newWindow(&opts, 10, nil)
+	var buffer bytes.Buffer
+
+	now := int64(1418052649)
+
+	p := &Packet{
+		Bucket:   "gaugordelete",
+		ValFlt:   12345,
+		ValStr:   "",
+		Modifier: "g",
+		Sampling: 1.0,
+	}
+
+	w.packetHandler(p)
+	num := w.processGauges(&buffer, now)
+	assert.Equal(t, num, int64(1))
+	assert.Equal(t, buffer.String(), "gaugordelete 12345 1418052649\n")
+
+	num = w.processGauges(&buffer, now+20)
+	assert.Equal(t, num, int64(0))
+	assert.Equal(t, buffer.String(), "gaugordelete 12345 1418052649\n")
+}
+
+func TestProcessPersistGauges(t *testing.T) {
+	opts := DefaultOptions()
+	opts.DeleteGauges = false
+	opts.PersistGaugeKeys = 2
+	w := newWindow(&opts, 10, nil)
+	var buffer bytes.Buffer
+
+	now := int64(1418052649)
+
+	p := &Packet{
+		Bucket:   "gaugor",
+		ValFlt:   12345,
+		ValStr:   "",
+		Modifier: "g",
+		Sampling: 1.0,
+	}
+	w.packetHandler(p)
+	assert.Equal(t, w.processGauges(&buffer, now), int64(1))
+	assert.Equal(t, w.processGauges(&buffer, now), int64(1))
+
+	// an update resets the inactivity
+	w.packetHandler(p)
+	assert.Equal(t, w.processGauges(&buffer, now), int64(1))
+	assert.Equal(t, w.processGauges(&buffer, now), int64(1))
+	assert.Equal(t, w.processGauges(&buffer, now), int64(1))
+	assert.Equal(t, w.processGauges(&buffer, now), int64(0))
+	assert.Equal(t, len(w.gauges), 0)
+	assert.Equal(t, len(w.gaugeInactivity), 0)
+}
+
+func TestProcessPersistTimers(t *testing.T) {
+	opts := DefaultOptions()
+	opts.PersistTimerKeys = 2
+	w := newWindow(&opts, 10, nil)
+	var buffer bytes.Buffer
+
+	now := int64(1418052649)
+
+	w.timers["response_time"] = []float64{10}
+	assert.Equal(t, w.processTimers(&buffer, now, Percentiles{}), int64(1))
+
+	buffer.Reset()
+	assert.Equal(t, w.processTimers(&buffer, now, Percentiles{}), int64(1))
+	assert.Equal(t, buffer.String(), "response_time.count 0 1418052649\n")
+	assert.Equal(t, w.processTimers(&buffer, now, Percentiles{}), int64(1))
+	assert.Equal(t, w.processTimers(&buffer, now, Percentiles{}), int64(0))
+
+	// each zero line is counted
+	opts.TimerStats.Set("count,count_ps")
+	w.timers["response_time"] = []float64{10}
+	w.processTimers(&buffer, now, Percentiles{})
+	buffer.Reset()
+	assert.Equal(t, w.processTimers(&buffer, now, Percentiles{}), int64(2))
+	assert.Equal(t, buffer.String(), "response_time.count 0 1418052649\nresponse_time.count_ps 0 1418052649\n")
+
+	// and none when neither is sent
+	opts.TimerStats.Set("mean")
+	buffer.Reset()
+	assert.Equal(t, w.processTimers(&buffer, now, Percentiles{}), int64(0))
+	assert.Equal(t, buffer.String(), "")
+}
+
+func TestProcessPersistSets(t *testing.T) {
+	opts := DefaultOptions()
+	opts.PersistSetKeys = 1
+	w := newWindow(&opts, 10, nil)
+	var buffer bytes.Buffer
+
+	now := int64(1418052649)
+
+	w.sets["uniques"] = []string{"123"}
+	assert.Equal(t, w.processSets(&buffer, now), int64(1))
+
+	buffer.Reset()
+	assert.Equal(t, w.processSets(&buffer, now), int64(1))
+	assert.Equal(t, buffer.String(), "uniques 0 1418052649\n")
+	assert.Equal(t, w.processSets(&buffer, now), int64(0))
+}
+
+func TestProcessSets(t *testing.T) {
+	opts := DefaultOptions()
+	w := newWindow(&opts, 10, nil)
+
+	now := int64(1418052649)
+
+	var buffer bytes.Buffer
+
+	// three unique values
+	w.sets["uniques"] = []string{"123", "234", "345"}
+	num := w.processSets(&buffer, now)
+	assert.Equal(t, num, int64(1))
+	assert.Equal(t, buffer.String(), "uniques 3 1418052649\n")
+
+	// one value is repeated
+	buffer.Reset()
+	w.sets["uniques"] = []string{"123", "234", "234"}
+	num = w.processSets(&buffer, now)
+	assert.Equal(t, num, int64(1))
+	assert.Equal(t, buffer.String(), "uniques 2 1418052649\n")
+
+	// make sure sets are purged
+	num = w.processSets(&buffer, now)
+	assert.Equal(t, num, int64(0))
+}
+
+func TestProcessSetsHyperLogLog(t *testing.T) {
+	opts := DefaultOptions()
+	opts.SetHLLThreshold = 3
+	w := newWindow(&opts, 10, nil)
+
+	now := int64(1418052649)
+
+	p := &Packet{
+		Bucket:   "uniques",
+		Modifier: "s",
+		Sampling: float32(1),
+	}
+	for _, v := range []string{"123", "234"} {
+		p.ValStr = v
+		w.packetHandler(p)
+	}
+	assert.Equal(t, len(w.sets["uniques"]), 2)
+	assert.Equal(t, len(w.setSketches), 0)
+
+	for _, v := range []string{"234", "345", "456"} {
+		p.ValStr = v
+		w.packetHandler(p)
+	}
+	assert.Equal(t, len(w.sets), 0)
+	assert.Equal(t, len(w.setSketches), 1)
+
+	var buffer bytes.Buffer
+	num := w.processSets(&buffer, now)
+	assert.Equal(t, num, int64(1))
+	assert.Equal(t, buffer.String(), "uniques 4 1418052649\n")
+
+	num = w.processSets(&buffer, now)
+	assert.Equal(t, num, int64(0))
+}
+
+func TestProcessTimersUpperPercentile(t *testing.T) {
+	opts := DefaultOptions()
+	// Some data with expected 75% of 2
+	w := newWindow(&opts, 10, nil)
+	w.timers["response_time"] = []float64{0, 1, 2, 3}
+
+	now := int64(1418052649)
+
+	var buffer bytes.Buffer
+	num := w.processTimers(&buffer, now, Percentiles{
+		&Percentile{
+			75,
+			"75",
+		},
+	})
+
+	lines := bytes.Split(buffer.Bytes(), []byte("\n"))
+
+	assert.Equal(t, num, int64(1))
+	assert.Equal(t, string(lines[0]), "response_time.upper_75 2 1418052649")
+}
+
+func TestProcessTimersUpperPercentilePostfix(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Postfix = ".test"
+	// Some data with expected 75% of 2
+	w := newWindow(&opts, 10, nil)
+	w.timers["postfix_response_time.test"] = []float64{0, 1, 2, 3}
+
+	now := int64(1418052649)
+
+	var buffer bytes.Buffer
+	num := w.processTimers(&buffer, now, Percentiles{
+		&Percentile{
+			75,
+			"75",
+		},
+	})
+
+	lines := bytes.Split(buffer.Bytes(), []byte("\n"))
+
+	assert.Equal(t, num, int64(1))
+	assert.Equal(t, string(lines[0]), "postfix_response_time.upper_75.test 2 1418052649")
+}
+
+func TestProcessTimesLowerPercentile(t *testing.T) {
+	opts := DefaultOptions()
+	w := newWindow(&opts, 10, nil)
+	w.timers["time"] = []float64{0, 1, 2, 3}
+
+	now := int64(1418052649)
+
+	var buffer bytes.Buffer
+	num := w.processTimers(&buffer, now, Percentiles{
+		&Percentile{
+			-75,
+			"-75",
+		},
+	})
+
+	lines := bytes.Split(buffer.Bytes(), []byte("\n"))
+
+	assert.Equal(t, num, int64(1))
+	assert.Equal(t, string(lines[0]), "time.lower_75 1 1418052649")
+}
+
+func TestEtsyNamespace(t *testing.T) {
+	opts := DefaultOptions()
+	opts.EtsyNamespace = true
+	opts.Postfix = ".test"
+	w := newWindow(&opts, 10, nil)
+	now := int64(1418052649)
+
+	var buffer bytes.Buffer
+	w.counters["gorets.test"] = 20
+	w.processCounters(&buffer, now)
+	assert.Equal(t, buffer.String(), "stats.counters.gorets.count.test 20 1418052649\nstats.counters.gorets.rate.test 2 1418052649\n")
+
+	buffer.Reset()
+	w.gauges["gaugor.test"] = 3
+	w.processGauges(&buffer, now)
+	assert.Equal(t, buffer.String(), "stats.gauges.gaugor.test 3 1418052649\n")
+
+	buffer.Reset()
+	w.sets["uniques.test"] = []string{"123", "234"}
+	w.processSets(&buffer, now)
+	assert.Equal(t, buffer.String(), "stats.sets.uniques.count.test 2 1418052649\n")
+
+	buffer.Reset()
+	opts.GlobalPrefix = ""
+	opts.PrefixTimer = "t"
+	w.timers["glork.test"] = []float64{1}
+	w.processTimers(&buffer, now, Percentiles{})
+	lines := bytes.Split(buffer.Bytes(), []byte("\n"))
+	assert.Equal(t, string(lines[0]), "t.glork.mean.test 1 1418052649")
+}
+
+func TestProcessHistograms(t *testing.T) {
+	opts := DefaultOptions()
+	opts.EtsyNamespace = true
+	w := newWindow(&opts, 10, nil)
+	now := int64(1418052649)
+
+	w.packetHandler(&Packet{Bucket: "glork", ValFlt: 2, Modifier: "h", Sampling: 1})
+	w.packetHandler(&Packet{Bucket: "glork", ValFlt: 4, Modifier: "h", Sampling: 1})
+	// without -forward-address distributions are histograms
+	w.packetHandler(&Packet{Bucket: "dist", ValFlt: 6, Modifier: "d", Sampling: 1})
+	assert.Equal(t, 0, len(w.timers))
+	assert.Equal(t, 0, len(w.distributions))
+
+	var buffer bytes.Buffer
+	num := w.processTimers(&buffer, now, Percentiles{})
+	assert.Equal(t, num, int64(2))
+	dataForGraphite := buffer.String()
+	assert.Contains(t, dataForGraphite, "stats.histograms.glork.mean 3 1418052649\n")
+	assert.Contains(t, dataForGraphite, "stats.histograms.glork.count 2 1418052649\n")
+	assert.Contains(t, dataForGraphite, "stats.histograms.dist.upper 6 1418052649\n")
+	assert.NotContains(t, dataForGraphite, "stats.timers.")
+}
+
+func TestHistogramAndTimerOfTheSameName(t *testing.T) {
+	opts := DefaultOptions()
+	opts.PersistTimerKeys = 1
+	w := newWindow(&opts, 10, nil)
+	now := int64(1418052649)
+
+	w.packetHandler(&Packet{Bucket: "glork", ValFlt: 2, Modifier: "ms", Sampling: 1})
+	w.packetHandler(&Packet{Bucket: "glork", ValFlt: 4, Modifier: "h", Sampling: 1})
+
+	var buffer bytes.Buffer
+	num := w.processTimers(&buffer, now, Percentiles{})
+	assert.Equal(t, num, int64(2))
+	dataForGraphite := buffer.String()
+	assert.Contains(t, dataForGraphite, "glork.mean 2 1418052649\n")
+	assert.Contains(t, dataForGraphite, "histograms.glork.mean 4 1418052649\n")
+
+	// and so are their zero counts once inactive
+	buffer.Reset()
+	w.processTimers(&buffer, now+10, Percentiles{})
+	assert.Equal(t, "glork.count 0 1418052659\nhistograms.glork.count 0 1418052659\n", buffer.String())
+}
+
+func TestHistogramNamesWithPrefixAndPostfix(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Prefix = "myapp."
+	opts.Postfix = ".local"
+	opts.PersistTimerKeys = 1
+	s := newTestServer(t, opts)
+	w := s.windows[0]
+	now := int64(1418052649)
+
+	s.handlePacket(ParseLine([]byte("lat:5|ms"))[0])
+	s.handlePacket(ParseLine([]byte("lat:7|h"))[0])
+
+	var buffer bytes.Buffer
+	w.processTimers(&buffer, now, Percentiles{})
+	dataForGraphite := buffer.String()
+	assert.Contains(t, dataForGraphite, "myapp.lat.mean.local 5 1418052649\n")
+	assert.Contains(t, dataForGraphite, "myapp.histograms.lat.mean.local 7 1418052649\n")
+
+	buffer.Reset()
+	w.processTimers(&buffer, now+10, Percentiles{})
+	assert.Equal(t, "myapp.lat.count.local 0 1418052659\nmyapp.histograms.lat.count.local 0 1418052659\n", buffer.String())
+}
+
+func TestForwardDistributions(t *testing.T) {
+	address, _ := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	listener, err := net.ListenUDP("udp", address)
+	assert.Equal(t, nil, err)
+	defer listener.Close()
+
+	opts := DefaultOptions()
+	opts.Prefix = "myapp."
+	opts.Postfix = ".local"
+	opts.ForwardAddress = listener.LocalAddr().String()
+	s := newTestServer(t, opts)
+	w := s.windows[0]
+	s.handlePacket(ParseLine([]byte("dist:5|d|@0.5"))[0])
+	s.handlePacket(ParseLine([]byte("dist:5|d"))[0])
+	assert.Equal(t, 0, len(w.histograms))
+
+	err = w.submit(1418052649, time.Now().Add(time.Second))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(w.distributions))
+
+	buf := make([]byte, 1500)
+	listener.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := listener.ReadFrom(buf)
+	assert.Equal(t, nil, err)
+	var weight float64
+	for _, line := range bytes.Split(buf[:n], []byte("\n")) {
+		packet := ParseLine(line)[0]
+		assert.NotEqual(t, packet, nil)
+		// without this host's prefix and postfix
+		assert.Equal(t, "dist", packet.Bucket)
+		assert.Equal(t, float64(5), packet.ValFlt)
+		assert.Equal(t, "d", packet.Modifier)
+		weight += float64(1 / packet.Sampling)
+	}
+	assert.InDelta(t, 3, weight, 0.001)
+}
+
+func TestWindowSpecs(t *testing.T) {
+	var ws WindowSpecs
+	assert.Equal(t, nil, ws.Set("60=longterm:2003"))
+	assert.Equal(t, nil, ws.Set("300=-"))
+	assert.Equal(t, int64(60), ws[0].Interval)
+	assert.Equal(t, "longterm:2003", ws[0].Backend.String())
+	assert.Equal(t, nil, ws[1].Backend)
+	assert.Equal(t, "[60=longterm:2003 300=-]", ws.String())
+
+	assert.NotEqual(t, nil, ws.Set("60"))
+	assert.NotEqual(t, nil, ws.Set("60="))
+	assert.NotEqual(t, nil, ws.Set("0=longterm:2003"))
+	assert.NotEqual(t, nil, ws.Set("x=longterm:2003"))
+}
+
+func TestMultipleWindows(t *testing.T) {
+	opts := DefaultOptions()
+	opts.CounterRates = true
+	opts.Windows.Set("60=-")
+	s := newTestServer(t, opts)
+	short, long := s.windows[0], s.windows[1]
+	now := int64(1418052649)
+
+	p := &Packet{
+		Bucket:   "gorets",
+		ValFlt:   30,
+		Modifier: "c",
+		Sampling: float32(1),
+	}
+	for _, w := range s.windows {
+		w.packetHandler(p)
+	}
+	s.countSelf("self", 1)
+
+	var buffer bytes.Buffer
+	short.processCounters(&buffer, now)
+	assert.Contains(t, buffer.String(), "gorets_ps 3 1418052649\n")
+	assert.Equal(t, long.counters["gorets"], float64(30))
+
+	for _, w := range s.windows {
+		w.packetHandler(p)
+	}
+
+	buffer.Reset()
+	long.processCounters(&buffer, now)
+	assert.Contains(t, buffer.String(), "gorets 60 1418052649\ngorets_ps 1 1418052649\n")
+	assert.Contains(t, buffer.String(), "self 1 1418052649\n")
+	assert.Equal(t, short.counters["gorets"], float64(30))
+}
+
+func TestNextBoundary(t *testing.T) {
+	period := 10 * time.Second
+	assert.Equal(t, int64(1418052650), nextBoundary(time.Unix(1418052649, 0), period).Unix())
+	assert.Equal(t, int64(1418052660), nextBoundary(time.Unix(1418052650, 0), period).Unix())
+	assert.Equal(t, int64(1418052660), nextBoundary(time.Unix(1418052650, 999), period).Unix())
+	assert.Equal(t, int64(1418052660), nextBoundary(time.Unix(1418052600, 1), time.Minute).Unix())
+}
+
+func TestAlignedTicks(t *testing.T) {
+	period := 50 * time.Millisecond
+	stop := make(chan struct{})
+	defer close(stop)
+	ticks := alignedTicks(period, stop)
+	for i := 0; i < 2; i++ {
+		select {
+		case tick := <-ticks:
+			assert.Equal(t, int64(0), tick.UnixNano()%int64(period))
+			assert.False(t, time.Now().Before(tick))
+		case <-time.After(time.Second):
+			t.Fatal("tick timeout")
+		}
+	}
+}
+
+func TestMultipleUDPSends(t *testing.T) {
+	addr := "127.0.0.1:8126"
+
+	address, _ := net.ResolveUDPAddr("udp", addr)
+	listener, err := net.ListenUDP("udp", address)
+	assert.Equal(t, nil, err)
+
+	s := newTestServer(t, DefaultOptions())
+	ch := s.in
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		s.ParseFrom(listener, false)
+		wg.Done()
+	}()
+
+	conn, err := net.DialTimeout("udp", addr, 50*time.Millisecond)
+	assert.Equal(t, nil, err)
+
+	n, err := conn.Write([]byte("deploys.test.myservice:2|c"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, len("deploys.test.myservice:2|c"), n)
+
+	n, err = conn.Write([]byte("deploys.test.my:service:2|c"))
+
+	n, err = conn.Write([]byte("deploys.test.myservice:1|c"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, len("deploys.test.myservice:1|c"), n)
+
+	select {
+	case pack := <-ch:
+		assert.Equal(t, "deploys.test.myservice", pack.Bucket)
+		assert.Equal(t, float64(2), pack.ValFlt)
+		assert.Equal(t, "c", pack.Modifier)
+		assert.Equal(t, float32(1), pack.Sampling)
+	case <-time.After(50 * time.Millisecond):
+		t.Fatal("packet receive timeout")
+	}
+
+	select {
+	case pack := <-ch:
+		assert.Equal(t, "deploys.test.myservice", pack.Bucket)
+		assert.Equal(t, float64(1), pack.ValFlt)
+		assert.Equal(t, "c", pack.Modifier)
+		assert.Equal(t, float32(1), pack.Sampling)
+	case <-time.After(50 * time.Millisecond):
+		t.Fatal("packet receive timeout")
+	}
+
+	listener.Close()
+	wg.Wait()
+}
+
+func TestServerLifecycle(t *testing.T) {
+	// servers share nothing, so each test can run its own in parallel
+	for _, bucket := range []string{"first", "second"} {
+		bucket := bucket
+		t.Run(bucket, func(t *testing.T) {
+			t.Parallel()
+			opts := DefaultOptions()
+			backend := &testBackend{}
+			opts.Backend = backend
+			listener := &UDPListener{Address: "127.0.0.1:0"}
+			opts.Listeners = []Listener{listener}
+			s := newTestServer(t, opts)
+			assert.NotEqual(t, nil, s.Flush())
+			assert.Equal(t, nil, s.Start())
+
+			conn, err := net.Dial("udp", listener.conn.LocalAddr().String())
+			assert.Equal(t, nil, err)
+			defer conn.Close()
+			_, err = conn.Write([]byte(bucket + ":1|c"))
+			assert.Equal(t, nil, err)
+			for i := 0; i < 100 && !strings.Contains(backend.output(), bucket+" 1 "); i++ {
+				time.Sleep(10 * time.Millisecond)
+				assert.Equal(t, nil, s.Flush())
+			}
+			assert.Contains(t, backend.output(), bucket+" 1 ")
+
+			assert.Equal(t, nil, s.Stop())
+			assert.Equal(t, nil, s.Stop())
+			assert.NotEqual(t, nil, s.Flush())
+		})
+	}
+}
+
+func TestFlushWithAlignFlush(t *testing.T) {
+	t.Parallel()
+	opts := DefaultOptions()
+	opts.AlignFlush = true
+	backend := &testBackend{}
+	opts.Backend = backend
+	s := newTestServer(t, opts)
+	assert.Equal(t, nil, s.Start())
+	s.in <- ParseLine([]byte("gorets:1|c"))[0]
+
+	// the boundary's own flush would overwrite it
+	assert.NotEqual(t, nil, s.Flush())
+	// but stopping sends it under the next boundary
+	assert.Equal(t, nil, s.Stop())
+	assert.Contains(t, backend.output(), "gorets 1 ")
+}
+
+func TestStopWithoutStart(t *testing.T) {
+	t.Parallel()
+	opts := DefaultOptions()
+	opts.Listeners = []Listener{&UDPListener{Address: "127.0.0.1:0"}}
+	s := newTestServer(t, opts)
+	assert.Equal(t, nil, s.Stop())
+	assert.Equal(t, nil, s.Stop())
+}
+
+func TestStopDrainsListeners(t *testing.T) {
+	opts := DefaultOptions()
+	backend := &testBackend{}
+	opts.Backend = backend
+	opts.Listeners = []Listener{
+		&UDPListener{Address: "127.0.0.1:8128"},
+		&TCPListener{Address: "127.0.0.1:8128"},
+	}
+	s := newTestServer(t, opts)
+	assert.Equal(t, nil, s.Start())
+
+	udp, err := net.Dial("udp", "127.0.0.1:8128")
+	assert.Equal(t, nil, err)
+	defer udp.Close()
+	tcp, err := net.Dial("tcp", "127.0.0.1:8128")
+	assert.Equal(t, nil, err)
+	defer tcp.Close()
+
+	_, err = tcp.Write([]byte("tcp.count:2|c\n"))
+	assert.Equal(t, nil, err)
+	// give the listener time to accept the connection
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < 100; i++ {
+		_, err = udp.Write([]byte("udp.count:1|c"))
+		assert.Equal(t, nil, err)
+	}
+
+	assert.Equal(t, nil, s.Stop())
+	assert.Contains(t, backend.output(), "udp.count 100 ")
+	assert.Contains(t, backend.output(), "tcp.count 2 ")
+
+	opts.Backend = &testBackend{err: errors.New("connection refused")}
+	opts.Listeners = nil
+	s = newTestServer(t, opts)
+	assert.Equal(t, nil, s.Start())
+	s.in <- ParseLine([]byte("gorets:1|c"))[0]
+	assert.NotEqual(t, nil, s.Stop())
+}
+
+func TestUnixListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsdaemon")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "statsd.sock")
+
+	opts := DefaultOptions()
+	backend := &testBackend{}
+	opts.Backend = backend
+	opts.Listeners = []Listener{&UnixListener{Path: path}}
+	s := newTestServer(t, opts)
+	assert.Equal(t, nil, s.Start())
+
+	conn, err := net.Dial("unixgram", path)
+	assert.Equal(t, nil, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("gorets:2|c\ngorets:3|c"))
+	assert.Equal(t, nil, err)
+
+	assert.Equal(t, nil, s.Stop())
+	assert.Contains(t, backend.output(), "gorets 5 ")
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSourceRateLimit(t *testing.T) {
+	opts := DefaultOptions()
+	addr := "127.0.0.1:8127"
+	opts.RateLimitCounter = "statsdaemon.rate_limited"
+
+	address, _ := net.ResolveUDPAddr("udp", addr)
+	listener, err := net.ListenUDP("udp", address)
+	assert.Equal(t, nil, err)
+
+	s := newTestServer(t, opts)
+	s.sourceLimits = newSourceLimiter(0.001, 1)
+	ch := s.in
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		s.ParseFrom(listener, false)
+		wg.Done()
+	}()
+
+	conn, err := net.DialTimeout("udp", addr, 50*time.Millisecond)
+	assert.Equal(t, nil, err)
+
+	_, err = conn.Write([]byte("deploys.test.myservice:2|c\ndeploys.test.myservice:1|c"))
+	assert.Equal(t, nil, err)
+
+	select {
+	case pack := <-ch:
+		assert.Equal(t, float64(2), pack.ValFlt)
+	case <-time.After(50 * time.Millisecond):
+		t.Fatal("packet receive timeout")
+	}
+
+	select {
+	case <-ch:
+		t.Fatal("packet over the rate limit was not dropped")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.countRateLimited(time.Now())
+	assert.Equal(t, s.windows[0].counters["statsdaemon.rate_limited.127_0_0_1"], float64(1))
+
+	listener.Close()
+	wg.Wait()
+}
+
+func BenchmarkManyDifferentSensors(t *testing.B) {
+	opts := DefaultOptions()
+	w := newWindow(&opts, 10, nil)
+	r := rand.New(rand.NewSource(438))
+	for i := 0; i < 1000; i++ {
+		bucket := "response_time" + strconv.Itoa(i)
+		for i := 0; i < 10000; i++ {
+			a := float64(r.Uint32() % 1000)
+			w.timers[bucket] = append(w.timers[bucket], a)
+		}
+	}
+
+	for i := 0; i < 1000; i++ {
+		bucket := "count" + strconv.Itoa(i)
+		for i := 0; i < 10000; i++ {
+			a := float64(r.Uint32() % 1000)
+			w.counters[bucket] = a
+		}
+	}
+
+	for i := 0; i < 1000; i++ {
+		bucket := "gauge" + strconv.Itoa(i)
+		for i := 0; i < 10000; i++ {
+			a := float64(r.Uint32() % 1000)
+			w.gauges[bucket] = a
+		}
+	}
+
+	var buff bytes.Buffer
+	now := time.Now().Unix()
+	t.ResetTimer()
+	w.processTimers(&buff, now, commonPercentiles)
+	w.processCounters(&buff, now)
+	w.processGauges(&buff, now)
+}
+
+func BenchmarkOneBigTimer(t *testing.B) {
+	opts := DefaultOptions()
+	w := newWindow(&opts, 10, nil)
+	r := rand.New(rand.NewSource(438))
+	bucket := "response_time"
+	for i := 0; i < 10000000; i++ {
+		a := float64(r.Uint32() % 1000)
+		w.timers[bucket] = append(w.timers[bucket], a)
+	}
+
+	var buff bytes.Buffer
+	t.ResetTimer()
+	w.processTimers(&buff, time.Now().Unix(), commonPercentiles)
+}
+
+func BenchmarkOneBigTimerDigest(t *testing.B) {
+	opts := DefaultOptions()
+	w := newWindow(&opts, 10, nil)
+	r := rand.New(rand.NewSource(438))
+	bucket := "response_time"
+	w.timerDigests[bucket] = NewTDigest(100)
+	for i := 0; i < 10000000; i++ {
+		a := float64(r.Uint32() % 1000)
+		w.timerDigests[bucket].Add(a)
+	}
+
+	var buff bytes.Buffer
+	t.ResetTimer()
+	w.processTimers(&buff, time.Now().Unix(), commonPercentiles)
+}
+
+func BenchmarkLotsOfTimers(t *testing.B) {
+	opts := DefaultOptions()
+	w := newWindow(&opts, 10, nil)
+	r := rand.New(rand.NewSource(438))
+	for i := 0; i < 1000; i++ {
+		bucket := "response_time" + strconv.Itoa(i)
+		for i := 0; i < 10000; i++ {
+			a := float64(r.Uint32() % 1000)
+			w.timers[bucket] = append(w.timers[bucket], a)
+		}
+	}
+
+	var buff bytes.Buffer
+	t.ResetTimer()
+	w.processTimers(&buff, time.Now().Unix(), commonPercentiles)
+}
+
+func BenchmarkMsgParserUDP(b *testing.B) {
+	r := &TestUdpReader{[]byte("a.key.with-0.dash:4|c\ngauge.with.longish.nameofserver:3|g")}
+	parser := NewParser(r, false, 1472)
+
+	for i := 0; i < b.N; i++ {
+		packet, more := parser.Next()
+		if more == false || packet == nil || packet.Modifier != "c" {
+			b.Fail()
+		}
+
+		packet, more = parser.Next()
+		if more == false || packet == nil || packet.Modifier != "g" {
+			b.Fail()
+		}
+	}
+}
+
+func BenchmarkMsgParserTCP(b *testing.B) {
+	// reads 16 bytes at a time
+	r := &TestTcpReader{[]byte("a.key.with-0.dash:4|c\ngauge.with.longish.nameofserver:3|g\n"), 1500, 0}
+	parser := NewParser(r, true, 1472)
+
+	for i := 0; i < b.N; i++ {
+		packet, more := parser.Next()
+		if more == false || packet == nil || packet.Modifier != "c" {
+			b.Fail()
+		}
+
+		packet, more = parser.Next()
+		if more == false || packet == nil || packet.Modifier != "g" {
+			b.Fail()
+		}
+	}
+}
+
+func BenchmarkParseLineCounter(b *testing.B) {
+	d1 := []byte("a.key.with-0.dash:4|c|@0.5")
+	d2 := []byte("normal.key.space:1|c")
+
+	for i := 0; i < b.N; i++ {
+		ParseLine(d1)
+		ParseLine(d2)
+	}
+}
+func BenchmarkParseLineGauge(b *testing.B) {
+	d1 := []byte("gaugor.whatever:333.4|g")
+	d2 := []byte("gaugor.whatever:-5|g")
+
+	for i := 0; i < b.N; i++ {
+		ParseLine(d1)
+		ParseLine(d2)
+	}
+}
+func BenchmarkParseLineTimer(b *testing.B) {
+	d1 := []byte("glork.some.keyspace:3.7211|ms")
+	d2 := []byte("glork.some.keyspace:11223|ms")
+
+	for i := 0; i < b.N; i++ {
+		ParseLine(d1)
+		ParseLine(d2)
+	}
+}
+func BenchmarkParseLineSet(b *testing.B) {
+	d1 := []byte("setof.some.keyspace:hiya|s")
+	d2 := []byte("setof.some.keyspace:411|s")
+
+	for i := 0; i < b.N; i++ {
+		ParseLine(d1)
+		ParseLine(d2)
+	}
+}
+func BenchmarkPacketHandlerCounter(b *testing.B) {
+	opts := DefaultOptions()
+	d1 := ParseLine([]byte("a.key.with-0.dash:4|c|@0.5"))[0]
+	d2 := ParseLine([]byte("normal.key.space:1|c"))[0]
+	w := newWindow(&opts, 10, nil)
+
+	for i := 0; i < b.N; i++ {
+		w.packetHandler(d1)
+		w.packetHandler(d2)
+	}
+}
+func BenchmarkPacketHandlerGauge(b *testing.B) {
+	opts := DefaultOptions()
+	d1 := ParseLine([]byte("gaugor.whatever:333.4|g"))[0]
+	d2 := ParseLine([]byte("gaugor.whatever:-5|g"))[0]
+	w := newWindow(&opts, 10, nil)
+
+	for i := 0; i < b.N; i++ {
+		w.packetHandler(d1)
+		w.packetHandler(d2)
+	}
+}
+func BenchmarkPacketHandlerTimer(b *testing.B) {
+	opts := DefaultOptions()
+	d1 := ParseLine([]byte("glork.some.keyspace:3.7211|ms"))[0]
+	d2 := ParseLine([]byte("glork.some.keyspace:11223|ms"))[0]
+	w := newWindow(&opts, 10, nil)
+
+	for i := 0; i < b.N; i++ {
+		w.packetHandler(d1)
+		w.packetHandler(d2)
+	}
+}
+func BenchmarkPacketHandlerSet(b *testing.B) {
+	opts := DefaultOptions()
+	d1 := ParseLine([]byte("setof.some.keyspace:hiya|s"))[0]
+	d2 := ParseLine([]byte("setof.some.keyspace:411|s"))[0]
+	w := newWindow(&opts, 10, nil)
+
+	for i := 0; i < b.N; i++ {
+		if i&0xff == 0xff {
+			w.sets = make(map[string][]string)
+		}
+		w.packetHandler(d1)
+		w.packetHandler(d2)
+	}
+}
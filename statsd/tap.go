@@ -0,0 +1,197 @@
+package statsd
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTapDuration = 10 * time.Second
+	maxTapDuration     = 5 * time.Minute
+	// tapBuffer lines may be waiting for a slow client before more are
+	// dropped, so that a tap never holds up aggregation
+	tapBuffer = 1000
+)
+
+// tap receives the incoming packets and/or outgoing lines whose bucket
+// matches a glob pattern.
+type tap struct {
+	pattern string
+	in, out bool
+	lines   chan string
+	dropped int
+}
+
+func (t *tap) matches(bucket string) bool {
+	ok, _ := path.Match(t.pattern, bucket)
+	return ok
+}
+
+func (t *tap) send(line string) {
+	select {
+	case t.lines <- line:
+	default:
+		t.dropped++
+	}
+}
+
+// taps are shared by a Server and its windows. They are added and removed
+// by admin requests while the monitor goroutine writes to them.
+type taps struct {
+	mu   sync.Mutex
+	list []*tap
+}
+
+func (ts *taps) add(t *tap) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.list = append(ts.list, t)
+}
+
+// remove unregisters t, returning how many lines it dropped.
+func (ts *taps) remove(t *tap) int {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for i, other := range ts.list {
+		if other == t {
+			ts.list = append(ts.list[:i], ts.list[i+1:]...)
+			break
+		}
+	}
+	return t.dropped
+}
+
+// incoming passes p, and what became of it, to the taps for incoming packets.
+func (ts *taps) incoming(p *Packet, fate string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if len(ts.list) == 0 {
+		return
+	}
+	var line string
+	for _, t := range ts.list {
+		if !t.in || !t.matches(p.Bucket) {
+			continue
+		}
+		if line == "" {
+			b, err := AppendLine([]byte("in "), p)
+			if err != nil {
+				// the parser lets through some packets that can't be
+				// encoded, such as sample rates over 1
+				value := p.ValStr
+				if p.Modifier != "s" {
+					value += strconv.FormatFloat(p.ValFlt, 'f', -1, 64)
+				}
+				b = []byte(fmt.Sprintf("in %s:%s|%s|@%g", p.Bucket, value, p.Modifier, p.Sampling))
+			}
+			line = string(b)
+			if fate != "" {
+				line += " (" + fate + ")"
+			}
+		}
+		t.send(line)
+	}
+}
+
+// outgoing passes the graphite lines a window sent to the taps for outgoing
+// lines.
+func (ts *taps) outgoing(interval int64, lines [][]byte) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if len(ts.list) == 0 {
+		return
+	}
+	for _, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		end := 0
+		for end < len(line) && line[end] != ' ' {
+			end++
+		}
+		name := string(line[:end])
+		for _, t := range ts.list {
+			if t.out && t.matches(name) {
+				t.send(fmt.Sprintf("out %ds %s", interval, line))
+			}
+		}
+	}
+}
+
+// serveTap streams what the server receives and/or sends for buckets
+// matching a glob pattern (default *), one line at a time, for a bounded time
+// (default 10s, at most 5m). Incoming packets are shown after renaming, with
+// the reason if they were dropped. Outgoing lines are matched by their full
+// graphite name.
+func (s *Server) serveTap(rw http.ResponseWriter, r *http.Request) {
+	t := &tap{pattern: r.FormValue("pattern"), lines: make(chan string, tapBuffer)}
+	if t.pattern == "" {
+		t.pattern = "*"
+	}
+	if _, err := path.Match(t.pattern, ""); err != nil {
+		http.Error(rw, fmt.Sprintf("invalid pattern %q - %s", t.pattern, err), http.StatusBadRequest)
+		return
+	}
+	switch r.FormValue("direction") {
+	case "in":
+		t.in = true
+	case "out":
+		t.out = true
+	case "", "both":
+		t.in, t.out = true, true
+	default:
+		http.Error(rw, "direction must be in, out or both", http.StatusBadRequest)
+		return
+	}
+	duration := defaultTapDuration
+	if d := r.FormValue("duration"); d != "" {
+		var err error
+		duration, err = time.ParseDuration(d)
+		if err != nil || duration <= 0 {
+			http.Error(rw, fmt.Sprintf("invalid duration %q", d), http.StatusBadRequest)
+			return
+		}
+		if duration > maxTapDuration {
+			duration = maxTapDuration
+		}
+	}
+
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.WriteHeader(http.StatusOK)
+	flusher, _ := rw.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	s.taps.add(t)
+	timeout := time.NewTimer(duration)
+	defer timeout.Stop()
+	for {
+		select {
+		case line := <-t.lines:
+			if _, err := fmt.Fprintln(rw, line); err != nil {
+				s.taps.remove(t)
+				return
+			}
+			if flusher != nil && len(t.lines) == 0 {
+				flusher.Flush()
+			}
+		case <-timeout.C:
+			dropped := s.taps.remove(t)
+			for len(t.lines) > 0 {
+				fmt.Fprintln(rw, <-t.lines)
+			}
+			if dropped > 0 {
+				fmt.Fprintf(rw, "dropped %d lines\n", dropped)
+			}
+			return
+		case <-r.Context().Done():
+			s.taps.remove(t)
+			return
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package statsd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTap(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Backend = &testBackend{}
+	opts.FilterRules.Set("deny glob gorets.debug")
+	s := newTestServer(t, opts)
+	assert.Equal(t, nil, s.Start())
+	defer s.Stop()
+
+	admin := httptest.NewServer(s.AdminHandler())
+	defer admin.Close()
+
+	body := make(chan string)
+	go func() {
+		resp, err := http.Get(admin.URL + "/tap?pattern=gorets*&duration=500ms")
+		assert.Equal(t, nil, err)
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		body <- string(b)
+	}()
+	for i := 0; ; i++ {
+		s.taps.mu.Lock()
+		n := len(s.taps.list)
+		s.taps.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("tap not added")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, line := range []string{"gorets:1|c|@0.5", "glork:320|ms", "gorets.debug:2|c"} {
+		s.in <- ParseLine([]byte(line))[0]
+	}
+	assert.Equal(t, nil, s.Flush())
+
+	lines := strings.Split(strings.TrimSpace(<-body), "\n")
+	assert.Equal(t, 3, len(lines))
+	assert.Equal(t, "in gorets:1|c|@0.5", lines[0])
+	assert.Equal(t, "in gorets.debug:2|c (denied by filter)", lines[1])
+	assert.True(t, strings.HasPrefix(lines[2], "out 10s gorets 2 "))
+}
+
+func TestTapUnencodablePackets(t *testing.T) {
+	var ts taps
+	tp := &tap{pattern: "*", in: true, lines: make(chan string, 10)}
+	ts.add(tp)
+	for _, line := range []string{"a:1|c|@2", "b:NaN|c", "c:-3|g"} {
+		packets := ParseLine([]byte(line))
+		assert.Equal(t, 1, len(packets), line)
+		ts.incoming(packets[0], "")
+	}
+	assert.Equal(t, "in a:1|c|@2", <-tp.lines)
+	assert.Equal(t, "in b:NaN|c|@1", <-tp.lines)
+	assert.Equal(t, "in c:-3|g", <-tp.lines)
+}
+
+func TestTapBadRequest(t *testing.T) {
+	s := newTestServer(t, DefaultOptions())
+	for _, query := range []string{"pattern=[", "direction=sideways", "duration=forever", "duration=-1s"} {
+		rec := httptest.NewRecorder()
+		s.AdminHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/tap?"+query, nil))
+		assert.Equal(t, http.StatusBadRequest, rec.Code, query)
+	}
+}
@@ -0,0 +1,233 @@
+package statsd
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+)
+
+// TDigest is a merging t-digest (Dunning & Ertl): a bounded-size sketch of a
+// distribution that answers quantile queries with error concentrated away
+// from the tails. Count, sum, sum of squares, min and max are tracked exactly.
+//
+// Two digests built with the same compression can be merged, so sketches can
+// be aggregated across hosts without shipping raw samples.
+type TDigest struct {
+	compression float64
+	centroids   []centroid
+	unmerged    []centroid
+
+	count      float64
+	sum        float64
+	sumSquares float64
+	min        float64
+	max        float64
+}
+
+type centroid struct {
+	mean   float64
+	weight float64
+}
+
+type centroidsByMean []centroid
+
+func (c centroidsByMean) Len() int           { return len(c) }
+func (c centroidsByMean) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c centroidsByMean) Less(i, j int) bool { return c[i].mean < c[j].mean }
+
+// NewTDigest returns an empty digest. Higher compression keeps more
+// centroids (roughly compression/2) and gives more accurate quantiles.
+func NewTDigest(compression float64) *TDigest {
+	return &TDigest{
+		compression: compression,
+		min:         math.Inf(1),
+		max:         math.Inf(-1),
+	}
+}
+
+func (td *TDigest) Add(value float64) {
+	td.add(value, 1)
+}
+
+func (td *TDigest) add(value float64, weight float64) {
+	td.unmerged = append(td.unmerged, centroid{value, weight})
+	td.count += weight
+	td.sum += value * weight
+	td.sumSquares += value * value * weight
+	if value < td.min {
+		td.min = value
+	}
+	if value > td.max {
+		td.max = value
+	}
+	if len(td.unmerged) >= td.bufferSize() {
+		td.compress()
+	}
+}
+
+// Merge folds other into td. other is left unchanged apart from having its
+// pending samples compressed.
+func (td *TDigest) Merge(other *TDigest) {
+	if other.count == 0 {
+		return
+	}
+	other.compress()
+	td.unmerged = append(td.unmerged, other.centroids...)
+	td.count += other.count
+	td.sum += other.sum
+	td.sumSquares += other.sumSquares
+	td.min = math.Min(td.min, other.min)
+	td.max = math.Max(td.max, other.max)
+	td.compress()
+}
+
+func (td *TDigest) bufferSize() int {
+	return int(math.Ceil(td.compression)) * 5
+}
+
+// scale is the k1 scale function; adjacent centroids may only be merged while
+// they span at most one unit of k.
+func (td *TDigest) scale(q float64) float64 {
+	return td.compression / (2 * math.Pi) * math.Asin(2*q-1)
+}
+
+func (td *TDigest) compress() {
+	if len(td.unmerged) == 0 {
+		return
+	}
+	all := append(td.centroids, td.unmerged...)
+	sort.Sort(centroidsByMean(all))
+
+	merged := make([]centroid, 0, len(td.centroids)+1)
+	cur := all[0]
+	var soFar float64
+	for _, c := range all[1:] {
+		q0 := soFar / td.count
+		q2 := (soFar + cur.weight + c.weight) / td.count
+		if td.scale(q2)-td.scale(q0) <= 1 {
+			cur.mean += (c.mean - cur.mean) * c.weight / (cur.weight + c.weight)
+			cur.weight += c.weight
+			continue
+		}
+		merged = append(merged, cur)
+		soFar += cur.weight
+		cur = c
+	}
+	td.centroids = append(merged, cur)
+	td.unmerged = nil
+}
+
+func (td *TDigest) Count() float64      { return td.count }
+func (td *TDigest) Sum() float64        { return td.sum }
+func (td *TDigest) SumSquares() float64 { return td.sumSquares }
+func (td *TDigest) Min() float64        { return td.min }
+func (td *TDigest) Max() float64        { return td.max }
+
+// Quantile estimates the value at quantile q (0-1), interpolating between
+// centroid centers and the exact min and max at the edges.
+func (td *TDigest) Quantile(q float64) float64 {
+	td.compress()
+	if len(td.centroids) == 0 {
+		return math.NaN()
+	}
+	if q <= 0 {
+		return td.min
+	}
+	if q >= 1 {
+		return td.max
+	}
+
+	target := q * td.count
+	first := td.centroids[0]
+	if target < first.weight/2 {
+		return td.min + (first.mean-td.min)*target/(first.weight/2)
+	}
+
+	var cum float64
+	for i := 0; i < len(td.centroids)-1; i++ {
+		c, next := td.centroids[i], td.centroids[i+1]
+		left := cum + c.weight/2
+		right := cum + c.weight + next.weight/2
+		if target <= right {
+			return c.mean + (next.mean-c.mean)*(target-left)/(right-left)
+		}
+		cum += c.weight
+	}
+
+	last := td.centroids[len(td.centroids)-1]
+	left := td.count - last.weight/2
+	if target <= left || last.weight == 0 {
+		return last.mean
+	}
+	return last.mean + (td.max-last.mean)*(target-left)/(last.weight/2)
+}
+
+// rangeStats estimates the count, sum and sum of squares of the samples lying
+// between quantiles lo and hi, assuming each centroid's weight sits at its mean.
+func (td *TDigest) rangeStats(lo float64, hi float64) (count float64, sum float64, sumSquares float64) {
+	td.compress()
+	lo *= td.count
+	hi *= td.count
+	var cum float64
+	for _, c := range td.centroids {
+		overlap := math.Min(cum+c.weight, hi) - math.Max(cum, lo)
+		if overlap > 0 {
+			count += overlap
+			sum += overlap * c.mean
+			sumSquares += overlap * c.mean * c.mean
+		}
+		cum += c.weight
+	}
+	return count, sum, sumSquares
+}
+
+// MarshalBinary encodes the digest so that it can be shipped to another
+// daemon and merged there.
+func (td *TDigest) MarshalBinary() ([]byte, error) {
+	td.compress()
+	buf := make([]byte, 8*(7+2*len(td.centroids)))
+	off := 0
+	put := func(v uint64) {
+		binary.BigEndian.PutUint64(buf[off:], v)
+		off += 8
+	}
+	for _, f := range []float64{td.compression, td.count, td.sum, td.sumSquares, td.min, td.max} {
+		put(math.Float64bits(f))
+	}
+	put(uint64(len(td.centroids)))
+	for _, c := range td.centroids {
+		put(math.Float64bits(c.mean))
+		put(math.Float64bits(c.weight))
+	}
+	return buf, nil
+}
+
+func (td *TDigest) UnmarshalBinary(data []byte) error {
+	if len(data) < 8*7 {
+		return errors.New("tdigest: short buffer")
+	}
+	next := func() float64 {
+		f := math.Float64frombits(binary.BigEndian.Uint64(data))
+		data = data[8:]
+		return f
+	}
+	td.compression = next()
+	td.count = next()
+	td.sum = next()
+	td.sumSquares = next()
+	td.min = next()
+	td.max = next()
+	n := binary.BigEndian.Uint64(data)
+	data = data[8:]
+	if n > uint64(len(data))/16 || uint64(len(data)) != n*16 {
+		return errors.New("tdigest: invalid centroid count")
+	}
+	td.centroids = make([]centroid, n)
+	for i := range td.centroids {
+		td.centroids[i].mean = next()
+		td.centroids[i].weight = next()
+	}
+	td.unmerged = nil
+	return nil
+}
@@ -0,0 +1,76 @@
+package statsd
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTDigestQuantiles(t *testing.T) {
+	r := rand.New(rand.NewSource(438))
+	td := NewTDigest(100)
+	for i := 0; i < 100000; i++ {
+		td.Add(float64(r.Uint32() % 1000))
+	}
+
+	assert.Equal(t, float64(100000), td.Count())
+	assert.Equal(t, float64(0), td.Min())
+	assert.Equal(t, float64(999), td.Max())
+	assert.InDelta(t, 500, td.Quantile(0.5), 10)
+	assert.InDelta(t, 990, td.Quantile(0.99), 2)
+	assert.InDelta(t, 10, td.Quantile(0.01), 2)
+	assert.True(t, len(td.centroids) < 200)
+}
+
+func TestTDigestSmall(t *testing.T) {
+	td := NewTDigest(100)
+	td.Add(5)
+	assert.Equal(t, float64(5), td.Quantile(0.5))
+	assert.Equal(t, float64(5), td.Quantile(0.99))
+
+	td = NewTDigest(100)
+	assert.True(t, math.IsNaN(td.Quantile(0.5)))
+}
+
+func TestTDigestMerge(t *testing.T) {
+	a := NewTDigest(100)
+	b := NewTDigest(100)
+	for i := 0; i < 1000; i++ {
+		a.Add(float64(i))
+		b.Add(float64(i + 1000))
+	}
+	a.Merge(b)
+
+	assert.Equal(t, float64(2000), a.Count())
+	assert.Equal(t, float64(0), a.Min())
+	assert.Equal(t, float64(1999), a.Max())
+	assert.Equal(t, float64(1999*2000/2), a.Sum())
+	assert.InDelta(t, 1000, a.Quantile(0.5), 10)
+	assert.Equal(t, float64(1000), b.Count())
+}
+
+func TestTDigestMarshalBinary(t *testing.T) {
+	td := NewTDigest(50)
+	for i := 0; i < 10000; i++ {
+		td.Add(float64(i % 100))
+	}
+	data, err := td.MarshalBinary()
+	assert.Equal(t, nil, err)
+
+	decoded := &TDigest{}
+	err = decoded.UnmarshalBinary(data)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, td.Count(), decoded.Count())
+	assert.Equal(t, td.SumSquares(), decoded.SumSquares())
+	assert.Equal(t, td.Quantile(0.9), decoded.Quantile(0.9))
+
+	assert.NotEqual(t, nil, decoded.UnmarshalBinary(data[:len(data)-8]))
+	assert.NotEqual(t, nil, decoded.UnmarshalBinary(data[:10]))
+
+	// a count whose size overflows
+	binary.BigEndian.PutUint64(data[8*6:], 1<<60)
+	assert.NotEqual(t, nil, decoded.UnmarshalBinary(data[:8*7]))
+}
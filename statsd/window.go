@@ -0,0 +1,708 @@
+package statsd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Float64Slice []float64
+
+func (s Float64Slice) Len() int           { return len(s) }
+func (s Float64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s Float64Slice) Less(i, j int) bool { return s[i] < s[j] }
+
+// window aggregates every received metric over its own flush interval and
+// sends the results to its own backend, so that e.g. 60s percentiles
+// are computed from raw samples rather than from 10s ones.
+type window struct {
+	opts      *Options
+	interval  int64 // seconds
+	backend   Backend
+	forward   string // where distributions go, if anywhere
+	taps      *taps  // nil outside a Server
+	log       *logger
+	lastFlush int64
+
+	counters        map[string]float64
+	gauges          map[string]float64
+	timers          map[string]Float64Slice
+	timerDigests    map[string]*TDigest
+	countInactivity map[string]int64
+	gaugeInactivity map[string]int64
+	timerInactivity map[string]int64
+	setInactivity   map[string]int64
+	sets            map[string][]string
+	setSketches     map[string]*HyperLogLog
+
+	histograms          map[string]Float64Slice
+	histogramDigests    map[string]*TDigest
+	histogramInactivity map[string]int64
+	distributions       map[string]*TDigest
+
+	// totals and values of counters and gauges by timestamp, for points sent
+	// with client timestamps that missed the flush of their interval
+	counterHistory map[int64]map[string]float64
+	lateCounters   map[int64]map[string]bool
+	lateGauges     map[int64]map[string]float64
+}
+
+func newWindow(opts *Options, interval int64, backend Backend) *window {
+	return &window{
+		opts:                opts,
+		interval:            interval,
+		backend:             backend,
+		counters:            make(map[string]float64),
+		gauges:              make(map[string]float64),
+		timers:              make(map[string]Float64Slice),
+		timerDigests:        make(map[string]*TDigest),
+		countInactivity:     make(map[string]int64),
+		gaugeInactivity:     make(map[string]int64),
+		timerInactivity:     make(map[string]int64),
+		setInactivity:       make(map[string]int64),
+		sets:                make(map[string][]string),
+		setSketches:         make(map[string]*HyperLogLog),
+		histograms:          make(map[string]Float64Slice),
+		histogramDigests:    make(map[string]*TDigest),
+		histogramInactivity: make(map[string]int64),
+		distributions:       make(map[string]*TDigest),
+		counterHistory:      make(map[int64]map[string]float64),
+		lateCounters:        make(map[int64]map[string]bool),
+		lateGauges:          make(map[int64]map[string]float64),
+	}
+}
+
+func (w *window) packetHandler(s *Packet) {
+	if w.opts.ReceiveCounter != "" {
+		v, ok := w.counters[w.opts.ReceiveCounter]
+		if !ok || v < 0 {
+			w.counters[w.opts.ReceiveCounter] = 0
+		}
+		w.counters[w.opts.ReceiveCounter] += 1
+	}
+
+	switch s.Modifier {
+	case "d":
+		if w.forward != "" {
+			digest, ok := w.distributions[s.Bucket]
+			if !ok {
+				digest = NewTDigest(w.opts.DistributionCompression)
+				w.distributions[s.Bucket] = digest
+			}
+			digest.add(s.ValFlt, float64(1/s.Sampling))
+			break
+		}
+		w.addTimerSample(w.histograms, w.histogramDigests, s)
+	case "h":
+		w.addTimerSample(w.histograms, w.histogramDigests, s)
+	case "ms":
+		w.addTimerSample(w.timers, w.timerDigests, s)
+	case "g":
+		if ts := w.lateTimestamp(s); ts != 0 {
+			late, ok := w.lateGauges[ts]
+			if !ok {
+				late = make(map[string]float64)
+				w.lateGauges[ts] = late
+			}
+			gaugeValue, ok := late[s.Bucket]
+			if !ok {
+				gaugeValue = w.gauges[s.Bucket]
+			}
+			late[s.Bucket] = applyGauge(gaugeValue, s)
+			break
+		}
+		w.gauges[s.Bucket] = applyGauge(w.gauges[s.Bucket], s)
+		delete(w.gaugeInactivity, s.Bucket)
+	case "c":
+		if ts := w.lateTimestamp(s); ts != 0 {
+			history, ok := w.counterHistory[ts]
+			if !ok {
+				history = make(map[string]float64)
+				w.counterHistory[ts] = history
+			}
+			history[s.Bucket] += s.ValFlt * float64(1/s.Sampling)
+			if _, ok := w.lateCounters[ts]; !ok {
+				w.lateCounters[ts] = make(map[string]bool)
+			}
+			w.lateCounters[ts][s.Bucket] = true
+			break
+		}
+		_, ok := w.counters[s.Bucket]
+		if !ok {
+			w.counters[s.Bucket] = 0
+		}
+		w.counters[s.Bucket] += s.ValFlt * float64(1/s.Sampling)
+	case "s":
+		if sketch, ok := w.setSketches[s.Bucket]; ok {
+			sketch.Add(s.ValStr)
+			break
+		}
+		_, ok := w.sets[s.Bucket]
+		if !ok {
+			w.sets[s.Bucket] = make([]string, 0)
+		}
+		w.sets[s.Bucket] = append(w.sets[s.Bucket], s.ValStr)
+		if w.opts.SetHLLThreshold > 0 && len(w.sets[s.Bucket]) >= w.opts.SetHLLThreshold {
+			sketch := NewHyperLogLog(uint8(w.opts.SetHLLPrecision))
+			for _, member := range w.sets[s.Bucket] {
+				sketch.Add(member)
+			}
+			w.setSketches[s.Bucket] = sketch
+			delete(w.sets, s.Bucket)
+		}
+	}
+}
+
+func (w *window) addTimerSample(timers map[string]Float64Slice, digests map[string]*TDigest, s *Packet) {
+	if w.opts.TimerCompression > 0 {
+		digest, ok := digests[s.Bucket]
+		if !ok {
+			digest = NewTDigest(w.opts.TimerCompression)
+			digests[s.Bucket] = digest
+		}
+		digest.Add(s.ValFlt)
+		return
+	}
+	_, ok := timers[s.Bucket]
+	if !ok {
+		var t Float64Slice
+		timers[s.Bucket] = t
+	}
+	timers[s.Bucket] = append(timers[s.Bucket], s.ValFlt)
+}
+
+func applyGauge(gaugeValue float64, s *Packet) float64 {
+	if s.ValStr == "" {
+		gaugeValue = s.ValFlt
+	} else if s.ValStr == "+" {
+		// watch out for overflows
+		if s.ValFlt > (math.MaxFloat64 - gaugeValue) {
+			gaugeValue = math.MaxFloat64
+		} else {
+			gaugeValue += s.ValFlt
+		}
+	} else if s.ValStr == "-" {
+		// subtract checking for negative numbers
+		if s.ValFlt > gaugeValue {
+			gaugeValue = 0
+		} else {
+			gaugeValue -= s.ValFlt
+		}
+	}
+	return gaugeValue
+}
+
+// lateTimestamp returns the timestamp a counter or gauge sent with a client
+// timestamp should be sent with, or 0 if it belongs to the current interval.
+// With -client-timestamps=aggregate that is the end of the interval the point
+// falls in, which is the timestamp that interval was flushed with, as
+// aggregating requires -align-flush.
+func (w *window) lateTimestamp(s *Packet) int64 {
+	if s.Timestamp == 0 || w.opts.ClientTimestamps == "ignore" || w.lastFlush-s.Timestamp > w.opts.MaxLateness {
+		return 0
+	}
+	if w.opts.ClientTimestamps == "forward" {
+		return s.Timestamp
+	}
+	if s.Timestamp > w.lastFlush {
+		return 0
+	}
+	return (s.Timestamp + w.interval - 1) / w.interval * w.interval
+}
+
+func (w *window) submit(now int64, deadline time.Time) error {
+	var buffer bytes.Buffer
+	var num int64
+
+	w.lastFlush = now
+
+	if w.forward != "" {
+		if err := w.forwardDistributions(); err != nil {
+			w.log.log(LevelError, "flush", "forwarding distributions failed", "address", w.forward, "error", err)
+		}
+	}
+
+	if w.backend == nil {
+		return nil
+	}
+
+	client, err := w.backend.Dial(deadline)
+	if err != nil {
+		if w.opts.Debug {
+			w.log.log(LevelWarning, "flush", "resetting counters when in debug mode")
+			w.processCounters(&buffer, now)
+			w.processGauges(&buffer, now)
+			w.processTimers(&buffer, now, w.opts.Percentiles)
+			w.processSets(&buffer, now)
+		}
+		errmsg := fmt.Sprintf("dialing %s failed - %s", w.backend, err)
+		return errors.New(errmsg)
+	}
+	defer client.Close()
+
+	num += w.processCounters(&buffer, now)
+	num += w.processGauges(&buffer, now)
+	num += w.processTimers(&buffer, now, w.opts.Percentiles)
+	num += w.processSets(&buffer, now)
+	if num == 0 {
+		return nil
+	}
+
+	if w.taps != nil {
+		w.taps.outgoing(w.interval, bytes.Split(buffer.Bytes(), []byte("\n")))
+	}
+
+	if w.log.enabled(LevelDebug, "flush") {
+		for _, line := range bytes.Split(buffer.Bytes(), []byte("\n")) {
+			if len(line) == 0 {
+				continue
+			}
+			w.log.log(LevelDebug, "flush", "sending", "line", line)
+		}
+	}
+
+	_, err = client.Write(buffer.Bytes())
+	if err != nil {
+		errmsg := fmt.Sprintf("failed to write stats - %s", err)
+		return errors.New(errmsg)
+	}
+
+	w.log.log(LevelInfo, "flush", "sent stats", "count", num, "backend", w.backend)
+	if w.opts.HeartbeatFile != "" {
+		if err := heartbeat(w.opts.HeartbeatFile); err != nil {
+			w.log.log(LevelError, "flush", "heartbeat failed", "error", err)
+		}
+	}
+
+	return nil
+}
+
+// forwardDistributions sends each distribution's centroids upstream as
+// sampled d values, so the aggregator there sees the same weighted
+// distribution and can compute percentiles across every host.
+func (w *window) forwardDistributions() error {
+	if len(w.distributions) == 0 {
+		return nil
+	}
+	var lines [][]byte
+	for bucket, digest := range w.distributions {
+		// the aggregator adds its own -prefix and -postfix
+		name := strings.TrimSuffix(strings.TrimPrefix(bucket, w.opts.Prefix), w.opts.Postfix)
+		digest.compress()
+		for _, c := range digest.centroids {
+			lines = append(lines, []byte(fmt.Sprintf("%s:%s|d|@%s", name,
+				strconv.FormatFloat(c.mean, 'f', -1, 64),
+				strconv.FormatFloat(1/c.weight, 'g', -1, 64))))
+		}
+		delete(w.distributions, bucket)
+	}
+
+	conn, err := net.Dial("udp", w.forward)
+	if err != nil {
+		return fmt.Errorf("dialing %s failed - %s", w.forward, err)
+	}
+	defer conn.Close()
+
+	var datagram []byte
+	for _, line := range lines {
+		if len(datagram) > 0 && len(datagram)+1+len(line) > w.opts.MaxUdpPacketSize {
+			if _, err := conn.Write(datagram); err != nil {
+				return fmt.Errorf("failed to forward distributions - %s", err)
+			}
+			datagram = datagram[:0]
+		}
+		if len(datagram) > 0 {
+			datagram = append(datagram, '\n')
+		}
+		datagram = append(datagram, line...)
+	}
+	if _, err := conn.Write(datagram); err != nil {
+		return fmt.Errorf("failed to forward distributions - %s", err)
+	}
+	return nil
+}
+
+func (w *window) processCounters(buffer *bytes.Buffer, now int64) int64 {
+	var num int64
+	// continue sending zeros for counters for a short period of time even if we have no new data
+	for bucket, value := range w.counters {
+		num += w.writeCounter(buffer, bucket, value, now)
+		delete(w.counters, bucket)
+		w.countInactivity[bucket] = 0
+		if w.opts.ClientTimestamps == "aggregate" {
+			if _, ok := w.counterHistory[now]; !ok {
+				w.counterHistory[now] = make(map[string]float64)
+			}
+			w.counterHistory[now][bucket] = value
+		}
+	}
+	// resend the new totals of earlier intervals that received late points
+	for ts, buckets := range w.lateCounters {
+		for bucket := range buckets {
+			num += w.writeCounter(buffer, bucket, w.counterHistory[ts][bucket], ts)
+		}
+		delete(w.lateCounters, ts)
+	}
+	for ts := range w.counterHistory {
+		if now-ts > w.opts.MaxLateness+w.interval {
+			delete(w.counterHistory, ts)
+		}
+	}
+	for bucket, purgeCount := range w.countInactivity {
+		if purgeCount > 0 {
+			num += w.writeCounter(buffer, bucket, 0, now)
+		}
+		w.countInactivity[bucket] += 1
+		if w.countInactivity[bucket] > w.opts.PersistCountKeys {
+			delete(w.countInactivity, bucket)
+		}
+	}
+	return num
+}
+
+func (w *window) writeCounter(buffer *bytes.Buffer, bucket string, value float64, now int64) int64 {
+	if w.opts.EtsyNamespace {
+		writeStat(buffer, w.metricName(w.opts.PrefixCounter, bucket, ".count"), value, now)
+		writeStat(buffer, w.metricName(w.opts.PrefixCounter, bucket, ".rate"), value/float64(w.interval), now)
+		return 2
+	}
+	writeStat(buffer, w.metricName(w.opts.PrefixCounter, bucket, ""), value, now)
+	if !w.opts.CounterRates {
+		return 1
+	}
+	writeStat(buffer, w.metricName(w.opts.PrefixCounter, bucket, w.opts.RateSuffix), value/float64(w.interval), now)
+	return 2
+}
+
+func (w *window) processGauges(buffer *bytes.Buffer, now int64) int64 {
+	var num int64
+
+	for ts, late := range w.lateGauges {
+		for bucket, value := range late {
+			writeStat(buffer, w.metricName(w.opts.PrefixGauge, bucket, ""), value, ts)
+			num++
+		}
+		delete(w.lateGauges, ts)
+	}
+	for bucket, currentValue := range w.gauges {
+		writeStat(buffer, w.metricName(w.opts.PrefixGauge, bucket, ""), currentValue, now)
+		num++
+		if w.opts.DeleteGauges {
+			delete(w.gauges, bucket)
+			continue
+		}
+		// keep sending the last value for a while, then expire the gauge
+		if w.opts.PersistGaugeKeys > 0 {
+			if w.gaugeInactivity[bucket] >= w.opts.PersistGaugeKeys {
+				delete(w.gauges, bucket)
+				delete(w.gaugeInactivity, bucket)
+			} else {
+				w.gaugeInactivity[bucket] += 1
+			}
+		}
+	}
+	return num
+}
+
+func (w *window) processSets(buffer *bytes.Buffer, now int64) int64 {
+	num := int64(len(w.sets) + len(w.setSketches))
+	for bucket, set := range w.sets {
+
+		uniqueSet := map[string]bool{}
+		for _, str := range set {
+			uniqueSet[str] = true
+		}
+
+		w.writeSet(buffer, bucket, uint64(len(uniqueSet)), now)
+		delete(w.sets, bucket)
+		w.setInactivity[bucket] = 0
+	}
+	for bucket, sketch := range w.setSketches {
+		w.writeSet(buffer, bucket, sketch.Count(), now)
+		delete(w.setSketches, bucket)
+		w.setInactivity[bucket] = 0
+	}
+	// continue sending zeros for sets for a short period of time even if we have no new data
+	for bucket, purgeCount := range w.setInactivity {
+		if purgeCount > 0 {
+			w.writeSet(buffer, bucket, 0, now)
+			num++
+		}
+		w.setInactivity[bucket] += 1
+		if w.setInactivity[bucket] > w.opts.PersistSetKeys {
+			delete(w.setInactivity, bucket)
+		}
+	}
+	return num
+}
+
+func (w *window) writeSet(buffer *bytes.Buffer, bucket string, count uint64, now int64) {
+	suffix := ""
+	if w.opts.EtsyNamespace {
+		suffix = ".count"
+	}
+	writeStat(buffer, w.metricName(w.opts.PrefixSet, bucket, suffix), float64(count), now)
+}
+
+// timerSummary holds everything processTimers emits for one timer, whether it
+// was computed from raw samples or estimated from a TDigest.
+type timerSummary struct {
+	count      float64
+	min        float64
+	max        float64
+	sum        float64
+	sumSquares float64
+	median     float64
+	std        float64
+	pcts       []percentileSummary // one per -percent-threshold, in order
+}
+
+type percentileSummary struct {
+	threshold  float64
+	count      float64
+	sum        float64
+	sumSquares float64
+}
+
+func (w *window) processTimers(buffer *bytes.Buffer, now int64, pctls Percentiles) int64 {
+	num := w.processTimerMaps(buffer, now, pctls, w.opts.PrefixTimer, "", w.timers, w.timerDigests, w.timerInactivity)
+	// histograms are kept apart from timers of the same name even without
+	// -etsy-namespace, which would put them under their type prefix anyway
+	namePrefix := ""
+	if !w.opts.EtsyNamespace && w.opts.PrefixHistogram != "" {
+		namePrefix = w.opts.PrefixHistogram + "."
+	}
+	num += w.processTimerMaps(buffer, now, pctls, w.opts.PrefixHistogram, namePrefix, w.histograms, w.histogramDigests, w.histogramInactivity)
+	return num
+}
+
+// processTimerMaps flushes either timers or histograms, which only differ in
+// their prefixes. namePrefix is inserted into every bucket name sent, after
+// any -prefix.
+func (w *window) processTimerMaps(buffer *bytes.Buffer, now int64, pctls Percentiles, typePrefix string, namePrefix string,
+	timers map[string]Float64Slice, digests map[string]*TDigest, inactivity map[string]int64) int64 {
+	var num int64
+	for bucket, timer := range timers {
+		num++
+		w.writeTimer(buffer, typePrefix, w.insertName(namePrefix, bucket), summarizeTimer(timer, pctls), pctls, now)
+		delete(timers, bucket)
+		inactivity[bucket] = 0
+	}
+	for bucket, digest := range digests {
+		num++
+		w.writeTimer(buffer, typePrefix, w.insertName(namePrefix, bucket), summarizeDigest(digest, pctls), pctls, now)
+		delete(digests, bucket)
+		inactivity[bucket] = 0
+	}
+	// continue sending a zero count for timers for a short period of time even if we have no new data
+	for bucket, purgeCount := range inactivity {
+		if purgeCount > 0 {
+			if w.opts.TimerStats["count"] {
+				w.writeTimerStat(buffer, typePrefix, w.insertName(namePrefix, bucket), "count", 0, now)
+				num++
+			}
+			if w.opts.TimerStats["count_ps"] {
+				w.writeTimerStat(buffer, typePrefix, w.insertName(namePrefix, bucket), "count"+w.opts.RateSuffix, 0, now)
+				num++
+			}
+		}
+		inactivity[bucket] += 1
+		if inactivity[bucket] > w.opts.PersistTimerKeys {
+			delete(inactivity, bucket)
+		}
+	}
+	return num
+}
+
+func summarizeTimer(timer Float64Slice, pctls Percentiles) *timerSummary {
+	sort.Sort(timer)
+	count := len(timer)
+	ts := &timerSummary{
+		count: float64(count),
+		min:   timer[0],
+		max:   timer[count-1],
+	}
+	ts.sum, ts.sumSquares = sumTimer(timer)
+	mean := ts.sum / ts.count
+
+	mid := count / 2
+	ts.median = timer[mid]
+	if count%2 == 0 {
+		ts.median = (timer[mid-1] + timer[mid]) / 2
+	}
+
+	var sumOfDiffs float64
+	for _, value := range timer {
+		sumOfDiffs += (value - mean) * (value - mean)
+	}
+	ts.std = math.Sqrt(sumOfDiffs / ts.count)
+
+	for _, pct := range pctls {
+		maxAtThreshold := ts.max
+		inThreshold := timer
+		if len(timer) > 1 {
+			var abs float64
+			if pct.float >= 0 {
+				abs = pct.float
+			} else {
+				abs = 100 + pct.float
+			}
+			// poor man's math.Round(x):
+			// math.Floor(x + 0.5)
+			indexOfPerc := int(math.Floor(((abs / 100.0) * float64(count)) + 0.5))
+			if pct.float >= 0 {
+				indexOfPerc -= 1 // index offset=0
+			}
+			if indexOfPerc < 0 {
+				indexOfPerc = 0
+			} else if indexOfPerc >= count {
+				indexOfPerc = count - 1
+			}
+			maxAtThreshold = timer[indexOfPerc]
+			if pct.float >= 0 {
+				inThreshold = timer[:indexOfPerc+1]
+			} else {
+				inThreshold = timer[indexOfPerc:]
+			}
+		}
+		p := percentileSummary{threshold: maxAtThreshold, count: float64(len(inThreshold))}
+		p.sum, p.sumSquares = sumTimer(inThreshold)
+		ts.pcts = append(ts.pcts, p)
+	}
+	return ts
+}
+
+// summarizeDigest estimates a timerSummary from a TDigest. count, min, max,
+// sum, sum_squares, mean and std are exact; everything else is approximate.
+func summarizeDigest(digest *TDigest, pctls Percentiles) *timerSummary {
+	ts := &timerSummary{
+		count:      digest.Count(),
+		min:        digest.Min(),
+		max:        digest.Max(),
+		sum:        digest.Sum(),
+		sumSquares: digest.SumSquares(),
+		median:     digest.Quantile(0.5),
+	}
+	mean := ts.sum / ts.count
+	ts.std = math.Sqrt(math.Max(ts.sumSquares/ts.count-mean*mean, 0))
+
+	for _, pct := range pctls {
+		var p percentileSummary
+		if pct.float >= 0 {
+			q := pct.float / 100
+			p.threshold = digest.Quantile(q)
+			p.count, p.sum, p.sumSquares = digest.rangeStats(0, q)
+		} else {
+			q := (100 + pct.float) / 100
+			p.threshold = digest.Quantile(q)
+			p.count, p.sum, p.sumSquares = digest.rangeStats(q, 1)
+		}
+		ts.pcts = append(ts.pcts, p)
+	}
+	return ts
+}
+
+func (w *window) writeTimer(buffer *bytes.Buffer, typePrefix string, bucket string, ts *timerSummary, pctls Percentiles, now int64) {
+	for i, pct := range pctls {
+		p := ts.pcts[i]
+		var pctstr string
+		if pct.float >= 0 {
+			pctstr = pct.str
+			if w.opts.TimerStats["upper_N"] {
+				w.writeTimerStat(buffer, typePrefix, bucket, "upper_"+pctstr, p.threshold, now)
+			}
+		} else {
+			pctstr = pct.str[1:]
+			if w.opts.TimerStats["lower_N"] {
+				w.writeTimerStat(buffer, typePrefix, bucket, "lower_"+pctstr, p.threshold, now)
+			}
+		}
+		if w.opts.TimerStats["mean_N"] && p.count > 0 {
+			w.writeTimerStat(buffer, typePrefix, bucket, "mean_"+pctstr, p.sum/p.count, now)
+		}
+		if w.opts.TimerStats["sum_N"] {
+			w.writeTimerStat(buffer, typePrefix, bucket, "sum_"+pctstr, p.sum, now)
+		}
+		if w.opts.TimerStats["sum_squares_N"] {
+			w.writeTimerStat(buffer, typePrefix, bucket, "sum_squares_"+pctstr, p.sumSquares, now)
+		}
+	}
+
+	if w.opts.TimerStats["mean"] {
+		w.writeTimerStat(buffer, typePrefix, bucket, "mean", ts.sum/ts.count, now)
+	}
+	if w.opts.TimerStats["upper"] {
+		w.writeTimerStat(buffer, typePrefix, bucket, "upper", ts.max, now)
+	}
+	if w.opts.TimerStats["lower"] {
+		w.writeTimerStat(buffer, typePrefix, bucket, "lower", ts.min, now)
+	}
+	if w.opts.TimerStats["count"] {
+		w.writeTimerStat(buffer, typePrefix, bucket, "count", ts.count, now)
+	}
+	if w.opts.TimerStats["count_ps"] {
+		w.writeTimerStat(buffer, typePrefix, bucket, "count"+w.opts.RateSuffix, ts.count/float64(w.interval), now)
+	}
+	if w.opts.TimerStats["median"] {
+		w.writeTimerStat(buffer, typePrefix, bucket, "median", ts.median, now)
+	}
+	if w.opts.TimerStats["std"] {
+		w.writeTimerStat(buffer, typePrefix, bucket, "std", ts.std, now)
+	}
+	if w.opts.TimerStats["sum"] {
+		w.writeTimerStat(buffer, typePrefix, bucket, "sum", ts.sum, now)
+	}
+	if w.opts.TimerStats["sum_squares"] {
+		w.writeTimerStat(buffer, typePrefix, bucket, "sum_squares", ts.sumSquares, now)
+	}
+}
+
+func sumTimer(values Float64Slice) (sum float64, sumSquares float64) {
+	for _, value := range values {
+		sum += value
+		sumSquares += value * value
+	}
+	return sum, sumSquares
+}
+
+func (w *window) writeTimerStat(buffer *bytes.Buffer, typePrefix string, bucket string, stat string, value float64, now int64) {
+	writeStat(buffer, w.metricName(typePrefix, bucket, "."+stat), value, now)
+}
+
+func writeStat(buffer *bytes.Buffer, name string, value float64, now int64) {
+	fmt.Fprintf(buffer, "%s %s %d\n", name, strconv.FormatFloat(value, 'f', -1, 64), now)
+}
+
+// insertName puts namePrefix in front of bucket, but behind the -prefix the
+// bucket was given, so that -prefix stays in front of every stat.
+func (w *window) insertName(namePrefix string, bucket string) string {
+	if strings.HasPrefix(bucket, w.opts.Prefix) {
+		return w.opts.Prefix + namePrefix + bucket[len(w.opts.Prefix):]
+	}
+	return namePrefix + bucket
+}
+
+// metricName builds the name sent to graphite for bucket, appending suffix
+// before any -postfix. With -etsy-namespace the global and per-type prefixes
+// are prepended as well.
+func (w *window) metricName(typePrefix string, bucket string, suffix string) string {
+	name, pfx := bucket, ""
+	// self-metrics such as -receive-counter don't carry the postfix
+	if strings.HasSuffix(bucket, w.opts.Postfix) {
+		name, pfx = bucket[:len(bucket)-len(w.opts.Postfix)], w.opts.Postfix
+	}
+	if w.opts.EtsyNamespace {
+		for _, p := range []string{typePrefix, w.opts.GlobalPrefix} {
+			if p != "" {
+				name = p + "." + name
+			}
+		}
+	}
+	return name + suffix + pfx
+}
@@ -1,616 +1,135 @@
 package main
 
 import (
-	"bytes"
-	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"log"
-	"math"
-	"net"
 	"os"
 	"os/signal"
 	"runtime"
-	"sort"
-	"strconv"
 	"strings"
 	"syscall"
-	"time"
-)
 
-const (
-	MAX_UNPROCESSED_PACKETS = 1000
-	TCP_READ_SIZE           = 4096
+	"github.com/bitly/statsdaemon/statsd"
 )
 
-var signalchan chan os.Signal
-
-type Packet struct {
-	Bucket   string
-	ValFlt   float64
-	ValStr   string
-	Modifier string
-	Sampling float32
-}
-
-type Float64Slice []float64
-
-func (s Float64Slice) Len() int           { return len(s) }
-func (s Float64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
-func (s Float64Slice) Less(i, j int) bool { return s[i] < s[j] }
-
-type Percentiles []*Percentile
-type Percentile struct {
-	float float64
-	str   string
-}
-
-func (a *Percentiles) Set(s string) error {
-	f, err := strconv.ParseFloat(s, 64)
-	if err != nil {
-		return err
-	}
-	*a = append(*a, &Percentile{f, strings.Replace(s, ".", "_", -1)})
-	return nil
-}
-func (p *Percentile) String() string {
-	return p.str
-}
-func (a *Percentiles) String() string {
-	return fmt.Sprintf("%v", *a)
-}
-
-func sanitizeBucket(bucket []byte) string {
-	var bl int
-
-	for i := 0; i < len(bucket); i++ {
-		c := bucket[i]
-		switch {
-		case c >= byte('a') && c <= byte('z'):
-			fallthrough
-		case c >= byte('A') && c <= byte('Z'):
-			fallthrough
-		case c >= byte('0') && c <= byte('9'):
-			fallthrough
-		case c == byte('-') || c == byte('.') || c == byte('_'):
-			bucket[bl] = c
-			bl++
-		case c == byte(' '):
-			bucket[bl] = byte('_')
-			bl++
-		case c == byte('/'):
-			bucket[bl] = byte('-')
-			bl++
-		}
-	}
-	return string(bucket[:bl])
-}
-
 var (
+	opts = statsd.DefaultOptions()
+
 	serviceAddress    = flag.String("address", ":8125", "UDP service address")
 	tcpServiceAddress = flag.String("tcpaddr", "", "TCP service address, if set")
-	maxUdpPacketSize  = flag.Int("max-udp-packet-size", 1472, "Maximum UDP packet size")
+	unixSocket        = flag.String("unix-socket", "", "unix datagram socket to listen on, if set")
 	graphiteAddress   = flag.String("graphite", "127.0.0.1:2003", "Graphite service address (or - to disable)")
-	flushInterval     = flag.Int64("flush-interval", 10, "Flush interval (seconds)")
-	debug             = flag.Bool("debug", false, "print statistics sent to graphite")
 	showVersion       = flag.Bool("version", false, "print version string")
-	deleteGauges      = flag.Bool("delete-gauges", true, "don't send values to graphite for inactive gauges, as opposed to sending the previous value")
-	persistCountKeys  = flag.Int64("persist-count-keys", 60, "number of flush-intervals to persist count keys")
-	receiveCounter    = flag.String("receive-counter", "", "Metric name for total metrics received per interval")
-	percentThreshold  = Percentiles{}
-	prefix            = flag.String("prefix", "", "Prefix for all stats")
-	postfix           = flag.String("postfix", "", "Postfix for all stats")
-	heartbeatFilePath = flag.String("heartbeat-file", "", "heartbeat file to update after a successful write to graphite.")
 )
 
 func init() {
-	flag.Var(&percentThreshold, "percent-threshold",
+	flag.IntVar(&opts.MaxUdpPacketSize, "max-udp-packet-size", opts.MaxUdpPacketSize, "Maximum UDP packet size")
+	flag.Int64Var(&opts.FlushInterval, "flush-interval", opts.FlushInterval, "Flush interval (seconds)")
+	flag.Int64Var(&opts.ShutdownTimeout, "shutdown-timeout", opts.ShutdownTimeout, "seconds to wait for the final flush when shutting down")
+	flag.StringVar(&opts.ClientTimestamps, "client-timestamps", opts.ClientTimestamps, "what to do with |T timestamps on counters and gauges: ignore, aggregate into the interval they belong to (needs -align-flush), or forward as is")
+	flag.Int64Var(&opts.MaxLateness, "max-lateness", opts.MaxLateness, "seconds before the last flush a -client-timestamps point may be, later ones count as current")
+	flag.BoolVar(&opts.AlignFlush, "align-flush", opts.AlignFlush, "flush on wall-clock multiples of -flush-interval, timestamped with the interval boundary")
+	flag.BoolVar(&opts.Debug, "debug", opts.Debug, "print statistics sent to graphite (unless -log-level sets flush)")
+	flag.BoolVar(&opts.DeleteGauges, "delete-gauges", opts.DeleteGauges, "don't send values to graphite for inactive gauges, as opposed to sending the previous value")
+	flag.Int64Var(&opts.PersistCountKeys, "persist-count-keys", opts.PersistCountKeys, "number of flush-intervals to persist count keys")
+	flag.Int64Var(&opts.PersistGaugeKeys, "persist-gauge-keys", opts.PersistGaugeKeys, "number of flush-intervals to keep sending the last value of inactive gauges with -delete-gauges=false (0 for ever)")
+	flag.Int64Var(&opts.PersistTimerKeys, "persist-timer-keys", opts.PersistTimerKeys, "number of flush-intervals to send a zero count for inactive timers")
+	flag.Int64Var(&opts.PersistSetKeys, "persist-set-keys", opts.PersistSetKeys, "number of flush-intervals to send zero for inactive sets")
+	flag.BoolVar(&opts.CounterRates, "counter-rates", opts.CounterRates, "also send a per-second rate for counters")
+	flag.StringVar(&opts.RateSuffix, "rate-suffix", opts.RateSuffix, "suffix for per-second rates of counters and the timer count_ps stat")
+	flag.BoolVar(&opts.EtsyNamespace, "etsy-namespace", opts.EtsyNamespace, "lay out names like Etsy statsd: <global-prefix>.<type prefix>.<bucket>[.count|.rate]")
+	flag.StringVar(&opts.GlobalPrefix, "global-prefix", opts.GlobalPrefix, "global prefix for all stats when using -etsy-namespace")
+	flag.StringVar(&opts.PrefixCounter, "prefix-counter", opts.PrefixCounter, "prefix for counters when using -etsy-namespace")
+	flag.StringVar(&opts.PrefixTimer, "prefix-timer", opts.PrefixTimer, "prefix for timers when using -etsy-namespace")
+	flag.StringVar(&opts.PrefixGauge, "prefix-gauge", opts.PrefixGauge, "prefix for gauges when using -etsy-namespace")
+	flag.StringVar(&opts.PrefixSet, "prefix-set", opts.PrefixSet, "prefix for sets when using -etsy-namespace")
+	flag.StringVar(&opts.PrefixHistogram, "prefix-histogram", opts.PrefixHistogram, "prefix for histograms, also without -etsy-namespace to keep them apart from timers")
+	flag.StringVar(&opts.ForwardAddress, "forward-address", opts.ForwardAddress, "UDP address of an upstream DogStatsD aggregator to forward distributions to (distributions are aggregated like histograms otherwise)")
+	flag.Float64Var(&opts.SourceRateLimit, "source-rate-limit", opts.SourceRateLimit, "maximum lines per second accepted from each source address (0 for no limit)")
+	flag.IntVar(&opts.SourceRateBurst, "source-rate-burst", opts.SourceRateBurst, "number of lines a source may send in a burst over -source-rate-limit (default one second's worth, at least 1)")
+	flag.StringVar(&opts.RateLimitCounter, "rate-limit-counter", opts.RateLimitCounter, "Metric name prefix for per-source counts of lines dropped by -source-rate-limit")
+	flag.StringVar(&opts.ReceiveCounter, "receive-counter", opts.ReceiveCounter, "Metric name for total metrics received per interval")
+	flag.StringVar(&opts.FilterCounter, "filter-counter", opts.FilterCounter, "Metric name prefix for per-rule counts of metrics dropped by -filter")
+	flag.StringVar(&opts.CardinalityCounter, "cardinality-counter", opts.CardinalityCounter, "Metric name for total metrics over a -cardinality-limit per interval")
+	flag.StringVar(&opts.CardinalityOverflow, "cardinality-overflow", opts.CardinalityOverflow, "what to do with new buckets over a -cardinality-limit: fold them into PREFIX__overflow__ or drop them")
+	flag.StringVar(&opts.Prefix, "prefix", opts.Prefix, "Prefix for all stats")
+	flag.StringVar(&opts.Postfix, "postfix", opts.Postfix, "Postfix for all stats")
+	flag.StringVar(&opts.StateFile, "state-file", opts.StateFile, "file to save aggregates and gauges to on shutdown, and gauges every -state-interval, and restore them from on startup")
+	flag.Int64Var(&opts.StateInterval, "state-interval", opts.StateInterval, "seconds between saves of -state-file (0 for only on shutdown)")
+	flag.Int64Var(&opts.StateMaxAge, "state-max-age", opts.StateMaxAge, "seconds after which -state-file is too old to restore")
+	flag.StringVar(&opts.AdminAddress, "admin-address", opts.AdminAddress, "HTTP address of the admin API (e.g. the /tap debug stream), if set")
+	flag.StringVar(&opts.RecordFile, "record", opts.RecordFile, "file to record every received line to, with its arrival time and source, for statsdaemon replay")
+	flag.StringVar(&opts.LogFormat, "log-format", opts.LogFormat, "log as text or json lines")
+	flag.IntVar(&opts.LogRateLimit, "log-rate-limit", opts.LogRateLimit, "warnings and errors with the same message logged per minute, e.g. for bad lines, before counting the rest (0 for no limit)")
+	flag.StringVar(&opts.HeartbeatFile, "heartbeat-file", opts.HeartbeatFile, "heartbeat file to update after a successful write to graphite.")
+	flag.IntVar(&opts.SetHLLThreshold, "set-hll-threshold", opts.SetHLLThreshold, "number of members after which a set is counted with a HyperLogLog estimate (0 to keep every member)")
+	flag.UintVar(&opts.SetHLLPrecision, "set-hll-precision", opts.SetHLLPrecision, "HyperLogLog precision for sets (4-18), higher is more accurate and uses 2^precision bytes")
+	flag.Float64Var(&opts.TimerCompression, "timer-compression", opts.TimerCompression, "t-digest compression for timers and histograms, higher is more accurate (0 to keep every sample)")
+	flag.Float64Var(&opts.DistributionCompression, "distribution-compression", opts.DistributionCompression, "t-digest compression for distributions forwarded to -forward-address")
+
+	flag.Var(&opts.Percentiles, "percent-threshold",
 		"percentile calculation for timers (0-100, may be given multiple times)")
+	flag.Var(&opts.FilterRules, "filter",
+		"allow or deny metrics by bucket as sent, before -prefix and -rewrite: \"allow|deny glob|regex PATTERN [TYPES]\" (first match wins, may be given multiple times)")
+	flag.Var(&opts.RewriteRules, "rewrite",
+		"rename buckets: \"regex PATTERN REPLACEMENT\" or \"OUTPUT = INPUT\" carbon-aggregator style (first match wins, may be given multiple times)")
+	flag.Var(&opts.CardinalityLimits, "cardinality-limit",
+		"maximum number of distinct buckets per interval starting with a prefix: \"PREFIX=N\" (first match wins, may be given multiple times)")
+	flag.Var(&opts.Windows, "window",
+		"additional flush interval with its own aggregation and graphite address: \"INTERVAL=GRAPHITE\" (may be given multiple times)")
+	flag.Var(&opts.EventSinks, "event-sink",
+		"where to send DogStatsD events and service checks: \"log\", \"graphite=URL\" (graphite-web /events/ API) or \"webhook=URL\" (may be given multiple times)")
+	flag.Var(&opts.LogLevels, "log-level",
+		"lowest level logged (debug, info, warning, error), optionally per subsystem: \"LEVEL,SUBSYSTEM=LEVEL,...\" ("+strings.Join(statsd.LogSubsystems, ",")+")")
+	flag.Var(opts.TimerStats, "timer-stats",
+		"comma separated list of stats to send for timers ("+strings.Join(statsd.TimerStatNames, ",")+")")
 }
 
-var (
-	In              = make(chan *Packet, MAX_UNPROCESSED_PACKETS)
-	counters        = make(map[string]float64)
-	gauges          = make(map[string]float64)
-	timers          = make(map[string]Float64Slice)
-	countInactivity = make(map[string]int64)
-	sets            = make(map[string][]string)
-)
-
-func monitor() {
-	period := time.Duration(*flushInterval) * time.Second
-	ticker := time.NewTicker(period)
-	for {
-		select {
-		case sig := <-signalchan:
-			fmt.Printf("!! Caught signal %v... shutting down\n", sig)
-			if err := submit(time.Now().Add(period)); err != nil {
-				log.Printf("ERROR: %s", err)
-			}
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "replay":
+			replay(os.Args[2:])
+			return
+		case "bench":
+			bench(os.Args[2:])
+			return
+		case "send":
+			send(os.Args[2:])
 			return
-		case <-ticker.C:
-			if err := submit(time.Now().Add(period)); err != nil {
-				log.Printf("ERROR: %s", err)
-			}
-		case s := <-In:
-			packetHandler(s)
-		}
-	}
-}
-
-func packetHandler(s *Packet) {
-	if *receiveCounter != "" {
-		v, ok := counters[*receiveCounter]
-		if !ok || v < 0 {
-			counters[*receiveCounter] = 0
-		}
-		counters[*receiveCounter] += 1
-	}
-
-	switch s.Modifier {
-	case "ms":
-		_, ok := timers[s.Bucket]
-		if !ok {
-			var t Float64Slice
-			timers[s.Bucket] = t
-		}
-		timers[s.Bucket] = append(timers[s.Bucket], s.ValFlt)
-	case "g":
-		gaugeValue, _ := gauges[s.Bucket]
-
-		if s.ValStr == "" {
-			gaugeValue = s.ValFlt
-		} else if s.ValStr == "+" {
-			// watch out for overflows
-			if s.ValFlt > (math.MaxFloat64 - gaugeValue) {
-				gaugeValue = math.MaxFloat64
-			} else {
-				gaugeValue += s.ValFlt
-			}
-		} else if s.ValStr == "-" {
-			// subtract checking for negative numbers
-			if s.ValFlt > gaugeValue {
-				gaugeValue = 0
-			} else {
-				gaugeValue -= s.ValFlt
-			}
-		}
-
-		gauges[s.Bucket] = gaugeValue
-	case "c":
-		_, ok := counters[s.Bucket]
-		if !ok {
-			counters[s.Bucket] = 0
-		}
-		counters[s.Bucket] += s.ValFlt * float64(1/s.Sampling)
-	case "s":
-		_, ok := sets[s.Bucket]
-		if !ok {
-			sets[s.Bucket] = make([]string, 0)
-		}
-		sets[s.Bucket] = append(sets[s.Bucket], s.ValStr)
-	}
-}
-
-func submit(deadline time.Time) error {
-	var buffer bytes.Buffer
-	var num int64
-
-	now := time.Now().Unix()
-
-	if *graphiteAddress == "-" {
-		return nil
-	}
-
-	client, err := net.Dial("tcp", *graphiteAddress)
-	if err != nil {
-		if *debug {
-			log.Printf("WARNING: resetting counters when in debug mode")
-			processCounters(&buffer, now)
-			processGauges(&buffer, now)
-			processTimers(&buffer, now, percentThreshold)
-			processSets(&buffer, now)
-		}
-		errmsg := fmt.Sprintf("dialing %s failed - %s", *graphiteAddress, err)
-		return errors.New(errmsg)
-	}
-	defer client.Close()
-
-	err = client.SetDeadline(deadline)
-	if err != nil {
-		return err
-	}
-
-	num += processCounters(&buffer, now)
-	num += processGauges(&buffer, now)
-	num += processTimers(&buffer, now, percentThreshold)
-	num += processSets(&buffer, now)
-	if num == 0 {
-		return nil
-	}
-
-	if *debug {
-		for _, line := range bytes.Split(buffer.Bytes(), []byte("\n")) {
-			if len(line) == 0 {
-				continue
-			}
-			log.Printf("DEBUG: %s", line)
-		}
-	}
-
-	_, err = client.Write(buffer.Bytes())
-	if err != nil {
-		errmsg := fmt.Sprintf("failed to write stats - %s", err)
-		return errors.New(errmsg)
-	}
-
-	log.Printf("sent %d stats to %s", num, *graphiteAddress)
-	if *heartbeatFilePath != "" {
-		heartbeat()
-	}
-
-	return nil
-}
-
-func processCounters(buffer *bytes.Buffer, now int64) int64 {
-	var num int64
-	// continue sending zeros for counters for a short period of time even if we have no new data
-	for bucket, value := range counters {
-		fmt.Fprintf(buffer, "%s %s %d\n", bucket, strconv.FormatFloat(value, 'f', -1, 64), now)
-		delete(counters, bucket)
-		countInactivity[bucket] = 0
-		num++
-	}
-	for bucket, purgeCount := range countInactivity {
-		if purgeCount > 0 {
-			fmt.Fprintf(buffer, "%s 0 %d\n", bucket, now)
-			num++
-		}
-		countInactivity[bucket] += 1
-		if countInactivity[bucket] > *persistCountKeys {
-			delete(countInactivity, bucket)
-		}
-	}
-	return num
-}
-
-func processGauges(buffer *bytes.Buffer, now int64) int64 {
-	var num int64
-
-	for bucket, currentValue := range gauges {
-		fmt.Fprintf(buffer, "%s %s %d\n", bucket, strconv.FormatFloat(currentValue, 'f', -1, 64), now)
-		num++
-		if *deleteGauges {
-			delete(gauges, bucket)
-		}
-	}
-	return num
-}
-
-func processSets(buffer *bytes.Buffer, now int64) int64 {
-	num := int64(len(sets))
-	for bucket, set := range sets {
-
-		uniqueSet := map[string]bool{}
-		for _, str := range set {
-			uniqueSet[str] = true
-		}
-
-		fmt.Fprintf(buffer, "%s %d %d\n", bucket, len(uniqueSet), now)
-		delete(sets, bucket)
-	}
-	return num
-}
-
-func processTimers(buffer *bytes.Buffer, now int64, pctls Percentiles) int64 {
-	var num int64
-	for bucket, timer := range timers {
-		bucketWithoutPostfix := bucket[:len(bucket)-len(*postfix)]
-		num++
-
-		sort.Sort(timer)
-		min := timer[0]
-		max := timer[len(timer)-1]
-		maxAtThreshold := max
-		count := len(timer)
-
-		sum := float64(0)
-		for _, value := range timer {
-			sum += value
-		}
-		mean := sum / float64(len(timer))
-
-		for _, pct := range pctls {
-			if len(timer) > 1 {
-				var abs float64
-				if pct.float >= 0 {
-					abs = pct.float
-				} else {
-					abs = 100 + pct.float
-				}
-				// poor man's math.Round(x):
-				// math.Floor(x + 0.5)
-				indexOfPerc := int(math.Floor(((abs / 100.0) * float64(count)) + 0.5))
-				if pct.float >= 0 {
-					indexOfPerc -= 1 // index offset=0
-				}
-				maxAtThreshold = timer[indexOfPerc]
-			}
-
-			var tmpl string
-			var pctstr string
-			if pct.float >= 0 {
-				tmpl = "%s.upper_%s%s %s %d\n"
-				pctstr = pct.str
-			} else {
-				tmpl = "%s.lower_%s%s %s %d\n"
-				pctstr = pct.str[1:]
-			}
-			threshold_s := strconv.FormatFloat(maxAtThreshold, 'f', -1, 64)
-			fmt.Fprintf(buffer, tmpl, bucketWithoutPostfix, pctstr, *postfix, threshold_s, now)
-		}
-
-		mean_s := strconv.FormatFloat(mean, 'f', -1, 64)
-		max_s := strconv.FormatFloat(max, 'f', -1, 64)
-		min_s := strconv.FormatFloat(min, 'f', -1, 64)
-
-		fmt.Fprintf(buffer, "%s.mean%s %s %d\n", bucketWithoutPostfix, *postfix, mean_s, now)
-		fmt.Fprintf(buffer, "%s.upper%s %s %d\n", bucketWithoutPostfix, *postfix, max_s, now)
-		fmt.Fprintf(buffer, "%s.lower%s %s %d\n", bucketWithoutPostfix, *postfix, min_s, now)
-		fmt.Fprintf(buffer, "%s.count%s %d %d\n", bucketWithoutPostfix, *postfix, count, now)
-
-		delete(timers, bucket)
-	}
-	return num
-}
-
-type MsgParser struct {
-	reader       io.Reader
-	newbuf       []byte
-	buffer       []byte
-	partialReads bool
-	done         bool
-}
-
-func NewParser(reader io.Reader, partialReads bool) *MsgParser {
-	bufsz := *maxUdpPacketSize
-	if partialReads {
-		bufsz = TCP_READ_SIZE
-	}
-	newbuf := make([]byte, bufsz)
-	return &MsgParser{reader, newbuf, newbuf[:0], partialReads, false}
-}
-
-func (mp *MsgParser) Next() (*Packet, bool) {
-	buf := mp.buffer
-
-	for {
-		line, rest := mp.lineFrom(buf)
-
-		if line != nil {
-			mp.buffer = rest
-			return parseLine(line), true
-		}
-
-		if mp.done {
-			if len(rest) > 0 {
-				return parseLine(rest), false
-			}
-			return nil, false
-		}
-
-		// for udp, each message independent
-		// for tcp, copy to front and append
-		// unless no '\n' in entire TCP_READ_SIZE
-		idx := 0
-		if mp.partialReads && len(buf) < TCP_READ_SIZE {
-			idx = len(buf)
-			copy(mp.newbuf, buf)
-		}
-		buf = mp.newbuf
-
-		n, err := mp.reader.Read(buf[idx:])
-		buf = buf[:idx+n]
-		if err != nil {
-			if err != io.EOF {
-				log.Printf("ERROR: %s", err)
-			}
-			mp.done = true
-		}
-	}
-}
-
-func (mp *MsgParser) lineFrom(input []byte) ([]byte, []byte) {
-	split := bytes.SplitN(input, []byte("\n"), 2)
-	if len(split) == 2 {
-		return split[0], split[1]
-	}
-
-	if !mp.partialReads {
-		if len(input) == 0 {
-			input = nil
-		}
-		return input, []byte{}
-	}
-
-	// if input ended in '\n' then len(split) == 2 and returned above
-	return nil, input
-}
-
-func parseLine(line []byte) *Packet {
-	split := bytes.SplitN(line, []byte{'|'}, 3)
-	if len(split) < 2 {
-		logParseFail(line)
-		return nil
-	}
-
-	keyval := split[0]
-	typeCode := string(split[1])
-
-	sampling := float32(1)
-	if typeCode == "c" || typeCode == "ms" {
-		if len(split) == 3 && len(split[2]) > 0 && split[2][0] == '@' {
-			f64, err := strconv.ParseFloat(string(split[2][1:]), 32)
-			if err != nil {
-				log.Printf(
-					"ERROR: failed to ParseFloat %s - %s",
-					string(split[2][1:]),
-					err,
-				)
-				return nil
-			}
-			sampling = float32(f64)
-		}
-	}
-
-	split = bytes.SplitN(keyval, []byte{':'}, 2)
-	if len(split) < 2 {
-		logParseFail(line)
-		return nil
-	}
-	name := split[0]
-	val := split[1]
-	if len(val) == 0 {
-		logParseFail(line)
-		return nil
-	}
-
-	var (
-		err      error
-		floatval float64
-		strval   string
-	)
-
-	switch typeCode {
-	case "c":
-		floatval, err = strconv.ParseFloat(string(val), 64)
-		if err != nil {
-			log.Printf("ERROR: failed to ParseFloat %s - %s", string(val), err)
-			return nil
-		}
-	case "g":
-		var s string
-
-		if val[0] == '+' || val[0] == '-' {
-			strval = string(val[0])
-			s = string(val[1:])
-		} else {
-			s = string(val)
-		}
-		floatval, err = strconv.ParseFloat(s, 64)
-		if err != nil {
-			log.Printf("ERROR: failed to ParseFloat %s - %s", string(val), err)
-			return nil
-		}
-	case "s":
-		strval = string(val)
-	case "ms":
-		floatval, err = strconv.ParseFloat(string(val), 64)
-		if err != nil {
-			log.Printf("ERROR: failed to ParseFloat %s - %s", string(val), err)
-			return nil
 		}
-	default:
-		log.Printf("ERROR: unrecognized type code %q for metric %q", typeCode, name)
-		return nil
 	}
+	flag.Parse()
 
-	return &Packet{
-		Bucket:   *prefix + sanitizeBucket(name) + *postfix,
-		ValFlt:   floatval,
-		ValStr:   strval,
-		Modifier: typeCode,
-		Sampling: sampling,
+	if *showVersion {
+		fmt.Printf("statsdaemon v%s (built w/%s)\n", VERSION, runtime.Version())
+		return
 	}
-}
 
-func logParseFail(line []byte) {
-	if *debug {
-		log.Printf("ERROR: failed to parse line: %q\n", string(line))
-	}
-}
-
-func parseTo(conn io.ReadCloser, partialReads bool, out chan<- *Packet) {
-	defer conn.Close()
-
-	parser := NewParser(conn, partialReads)
-	for {
-		p, more := parser.Next()
-		if p != nil {
-			out <- p
-		}
-
-		if !more {
-			break
-		}
+	opts.Backend = statsd.NewGraphiteBackend(*graphiteAddress)
+	opts.Listeners = append(opts.Listeners, &statsd.UDPListener{Address: *serviceAddress})
+	if *tcpServiceAddress != "" {
+		opts.Listeners = append(opts.Listeners, &statsd.TCPListener{Address: *tcpServiceAddress})
 	}
-}
-
-func udpListener() {
-	address, _ := net.ResolveUDPAddr("udp", *serviceAddress)
-	log.Printf("listening on %s", address)
-	listener, err := net.ListenUDP("udp", address)
-	if err != nil {
-		log.Fatalf("ERROR: ListenUDP - %s", err)
+	if *unixSocket != "" {
+		opts.Listeners = append(opts.Listeners, &statsd.UnixListener{Path: *unixSocket})
 	}
 
-	parseTo(listener, false, In)
-}
-
-func tcpListener() {
-	address, _ := net.ResolveTCPAddr("tcp", *tcpServiceAddress)
-	log.Printf("listening on %s", address)
-	listener, err := net.ListenTCP("tcp", address)
+	server, err := statsd.NewServer(opts)
 	if err != nil {
-		log.Fatalf("ERROR: ListenTCP - %s", err)
-	}
-	defer listener.Close()
-
-	for {
-		conn, err := listener.AcceptTCP()
-		if err != nil {
-			log.Fatalf("ERROR: AcceptTCP - %s", err)
-		}
-		go parseTo(conn, true, In)
-	}
-}
-
-func heartbeat() {
-	_, err := os.Stat(*heartbeatFilePath)
-	if err != nil && os.IsNotExist(err) {
-		file, err := os.Create(*heartbeatFilePath)
-		if err != nil {
-			log.Fatalf("ERROR: Creating heartbeat file - %s", err)
-		}
-		defer file.Close()
-	} else if err != nil {
 		log.Fatalf("ERROR: %s", err)
 	}
 
-	currentTime := time.Now()
-	err = os.Chtimes(*heartbeatFilePath, currentTime, currentTime)
-	if err != nil {
-		log.Fatalf("ERROR: Touching %s", err)
-	}
-}
+	signalchan := make(chan os.Signal, 1)
+	signal.Notify(signalchan, syscall.SIGINT, syscall.SIGTERM)
 
-func main() {
-	flag.Parse()
-
-	if *showVersion {
-		fmt.Printf("statsdaemon v%s (built w/%s)\n", VERSION, runtime.Version())
-		return
+	if err := server.Start(); err != nil {
+		log.Fatalf("ERROR: %s", err)
 	}
-	*prefix = sanitizeBucket([]byte(*prefix))
-	*postfix = sanitizeBucket([]byte(*postfix))
-
-	signalchan = make(chan os.Signal, 1)
-	signal.Notify(signalchan, syscall.SIGTERM)
-
-	go udpListener()
-	if *tcpServiceAddress != "" {
-		go tcpListener()
+	sig := <-signalchan
+	fmt.Printf("!! Caught signal %v... shutting down\n", sig)
+	if err := server.Stop(); err != nil {
+		log.Fatalf("ERROR: final flush failed - %s", err)
 	}
-	monitor()
 }